@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	azureReadModel       = "prebuilt-read"
+	azureLayoutModel     = "prebuilt-layout"
+	azureIDDocumentModel = "prebuilt-idDocument"
+
+	azureAnalysisPollInterval = time.Second
+	azureAnalysisMaxPolls     = 20
+
+	// a structured value and the llm value at least this similar verify each other
+	minVerifySimilarity = 0.9
+)
+
+// azureModels is the model used per doc type, AZURE_MODEL_<DOCTYPE> overrides it, e.g.
+// AZURE_MODEL_PAN=pan-custom-v2 for a trained custom model.
+var azureModels = map[string]string{
+	panDoc:     azureReadModel,
+	aadharDoc:  azureReadModel,
+	unknownDoc: azureReadModel,
+}
+
+// idDocumentFields maps the prebuilt-idDocument fields onto the keys returned by the llm prompts. Custom
+// models are expected to be trained with those keys directly.
+var idDocumentFields = map[string]string{
+	"DocumentNumber": "docNumber",
+	"DateOfBirth":    "dateOfBirth",
+	"DateOfIssue":    "issueDate",
+	"Sex":            "gender",
+	"FatherName":     "fatherName",
+	"Address":        "address",
+}
+
+// azureModelPattern is the form of azure model ids. The model goes into the path of the requests that
+// carry the subscription key, anything else could send them to another endpoint.
+var azureModelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._~-]{1,63}$`)
+
+func azureModelFor(docType string, override string) (string, error) {
+	if override != "" {
+		if !azureModelPattern.MatchString(override) {
+			return "", fmt.Errorf("invalid azure model: %s", override)
+		}
+		return override, nil
+	}
+	if m := os.Getenv("AZURE_MODEL_" + docType); m != "" {
+		return m, nil
+	}
+	if m, ok := azureModels[docType]; ok {
+		return m, nil
+	}
+	return azureReadModel, nil
+}
+
+// isStructuredModel tells whether the model returns documents with fields rather than just text.
+func isStructuredModel(model string) bool {
+	return model != azureReadModel && model != azureLayoutModel
+}
+
+// waitForOCRAnalysisResult polls azure until the analysis is done, structured models take longer than read.
+func waitForOCRAnalysisResult(requestID string, model string) (*OCRAnalysisResult, error) {
+	for i := 0; i < azureAnalysisMaxPolls; i++ {
+		// every poll is a request counted against the rate limit of azure, the same as the submit
+		waitForProvider(engineAzure)
+		result, err := fetchOCRAnalysisResult(requestID, model)
+		if err != nil {
+			return nil, err
+		}
+
+		switch result.Status {
+		case "succeeded":
+			return result, nil
+		case "failed":
+			return nil, fmt.Errorf("azure analysis failed")
+		}
+		sleep(azureAnalysisPollInterval)
+	}
+	return nil, fmt.Errorf("azure analysis did not complete after %d polls", azureAnalysisMaxPolls)
+}
+
+// structuredFields converts the fields of the first document azure found into our field structure,
+// returning nil when the model gave none.
+func structuredFields(result *AnalyzeResult, model string, docType string) map[string]interface{} {
+	if !isStructuredModel(model) || len(result.Documents) == 0 {
+		return nil
+	}
+
+	doc := result.Documents[0]
+	fields := map[string]interface{}{}
+	for name, f := range doc.Fields {
+		key := name
+		if model == azureIDDocumentModel {
+			mapped, ok := idDocumentFields[name]
+			if !ok {
+				continue
+			}
+			key = mapped
+		}
+		fields[key] = documentFieldValue(f)
+	}
+
+	// prebuilt-idDocument splits the name, the prompts return it whole
+	if model == azureIDDocumentModel {
+		var parts []string
+		for _, name := range []string{"FirstName", "LastName"} {
+			if f, ok := doc.Fields[name]; ok && documentFieldValue(f) != "nil" {
+				parts = append(parts, documentFieldValue(f))
+			}
+		}
+		if len(parts) > 0 {
+			fields["fullName"] = strings.Join(parts, " ")
+		} else {
+			fields["fullName"] = "nil"
+		}
+	}
+
+	// spelled the way the llm prompts return it, whichever path extracted the fields
+	if t, ok := ruleDocTypes[docType]; ok {
+		fields["docType"] = t
+	} else if docType != unknownDoc {
+		fields["docType"] = docType
+	}
+	return fields
+}
+
+// documentFieldValue returns the value as printed on the document, like the llm does, e.g. "05/12/1989"
+// rather than the normalized valueDate.
+func documentFieldValue(f DocumentField) string {
+	switch {
+	case f.Content != "":
+		return f.Content
+	case f.ValueString != "":
+		return f.ValueString
+	case f.ValueDate != "":
+		return f.ValueDate
+	}
+	return "nil"
+}
+
+// verifyStructuredFields checks the structured model output against the llm and fills in the fields the
+// model did not find. It returns whether each structured value was confirmed by the llm.
+func verifyStructuredFields(structured map[string]interface{}, llm map[string]interface{}) map[string]bool {
+	verified := map[string]bool{}
+	for k, v := range structured {
+		if isMissingValue(v) {
+			continue
+		}
+		s, _ := v.(string)
+		l, ok := llm[k].(string)
+		verified[k] = ok && !isMissingValue(l) && similarity(normalizeForMatch(s), normalizeForMatch(l)) >= minVerifySimilarity
+	}
+
+	for k, v := range llm {
+		if isMissingValue(structured[k]) && !isMissingValue(v) {
+			structured[k] = v
+		}
+	}
+	return verified
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bureau-Inc/overwatch-common/logger"
+	"github.com/Bureau-Inc/overwatch-common/logger/tag"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	batchPath = "/batch"
+
+	jobKindBatch = "batch"
+
+	defaultBatchConcurrency = 4
+	// defaultMaxBatchItems is the most items answered in the request itself, larger batches go through
+	// a manifest and a job. A document takes up to about 15s with the rate limits, so one round of
+	// defaultBatchConcurrency documents is all that fits in the 29s api gateway timeout
+	defaultMaxBatchItems = defaultBatchConcurrency
+	// batchChunkSize items are written to each part of the results of a manifest
+	batchChunkSize = 50
+	// defaultBatchTimeBudget leaves a lambda time to store its progress before its 15 minutes run out
+	defaultBatchTimeBudget = 10 * time.Minute
+)
+
+// batchRequest is either a list of items answered right away, or an s3 manifest run as a job. The
+// manifest is a json array of items or one item per line, its results are written as json lines under
+// Output, <manifest>.results by default.
+type batchRequest struct {
+	Items       []batchItem `json:"items"`
+	Manifest    string      `json:"manifest"`
+	Output      string      `json:"output"`
+	Concurrency int         `json:"concurrency"`
+	CallbackURL string      `json:"callbackUrl"`
+}
+
+// batchItem is a payload with an id to match it with its result, its index when absent.
+type batchItem struct {
+	ID string `json:"id"`
+	payload
+}
+
+// batchResult is the response the item would have got on its own. Error repeats the error of a failed one.
+type batchResult struct {
+	Index      int             `json:"index"`
+	ID         string          `json:"id"`
+	StatusCode int             `json:"statusCode"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// batchProgress is kept on the job of a manifest so that it carries on where it stopped.
+type batchProgress struct {
+	Total     int      `json:"total"`
+	Processed int      `json:"processed"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+	Parts     []string `json:"parts"`
+}
+
+// checkBuckets makes sure the manifest is read from and the results written to buckets of
+// S3_ALLOWED_BUCKETS, the caller picks them and the role of the function reaches more buckets.
+func (b *batchRequest) checkBuckets() error {
+	uris := []string{b.Manifest}
+	if b.Output != "" {
+		uris = append(uris, b.Output)
+	}
+	for _, uri := range uris {
+		bucket, _, err := parseS3URI(uri)
+		if err != nil {
+			return err
+		}
+		if !s3BucketAllowed(bucket) {
+			return fmt.Errorf("the s3 bucket %s is not allowed", bucket)
+		}
+	}
+	return nil
+}
+
+func isBatchPath(path string) bool {
+	return strings.HasSuffix(strings.TrimRight(path, "/"), batchPath)
+}
+
+func maxBatchItems() int {
+	if n, err := strconv.Atoi(os.Getenv("BATCH_MAX_ITEMS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxBatchItems
+}
+
+// batchConcurrency is the concurrency asked for, capped by BATCH_CONCURRENCY.
+func batchConcurrency(requested int) int {
+	limit := defaultBatchConcurrency
+	if n, err := strconv.Atoi(os.Getenv("BATCH_CONCURRENCY")); err == nil && n > 0 {
+		limit = n
+	}
+	if requested <= 0 || requested > limit {
+		return limit
+	}
+	return requested
+}
+
+// submitBatch answers a list of items with the result of each, and queues a manifest as a batch job.
+func submitBatch(req events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	b := &batchRequest{}
+	if err := json.Unmarshal([]byte(req.Body), b); err != nil {
+		return buildBadRequestResp(fmt.Errorf("failed to unmarshal input:%v", err))
+	}
+	if b.CallbackURL != "" {
+		if err := validateCallbackURL(b.CallbackURL); err != nil {
+			return buildJSONResp(http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		}
+	}
+
+	if b.Manifest != "" {
+		if len(b.Items) > 0 {
+			return buildJSONResp(http.StatusBadRequest, map[string]interface{}{"error": "provide either items or a manifest"})
+		}
+		if err := b.checkBuckets(); err != nil {
+			return buildJSONResp(http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		}
+		return queueJob(jobKindBatch, req.Body, tenantOf(req))
+	}
+
+	if len(b.Items) == 0 {
+		return buildJSONResp(http.StatusBadRequest, map[string]interface{}{"error": "provide items or a manifest"})
+	}
+	if len(b.Items) > maxBatchItems() {
+		return buildJSONResp(http.StatusBadRequest, map[string]interface{}{
+			"error": fmt.Sprintf("at most %d items are processed in a request, submit larger batches as a manifest", maxBatchItems()),
+		})
+	}
+
+	results := runBatch(b.Items, 0, b.Concurrency, tenantOf(req))
+	succeeded := 0
+	for _, r := range results {
+		if r.Error == "" {
+			succeeded++
+		}
+	}
+	return buildJSONResp(http.StatusOK, map[string]interface{}{
+		"total":     len(results),
+		"succeeded": succeeded,
+		"failed":    len(results) - succeeded,
+		"items":     results,
+	})
+}
+
+// runBatch processes the items through the same pipeline as single requests, a few at a time. offset is
+// the index of the first item in the whole batch.
+func runBatch(items []batchItem, offset int, concurrency int, tenant string) []batchResult {
+	results := make([]batchResult, len(items))
+	sem := make(chan struct{}, batchConcurrency(concurrency))
+	var wg sync.WaitGroup
+	for i := range items {
+		i := i
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = processBatchItem(&items[i], offset+i, tenant)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func processBatchItem(item *batchItem, index int, tenant string) batchResult {
+	r := batchResult{Index: index, ID: item.ID}
+	if r.ID == "" {
+		r.ID = strconv.Itoa(index)
+	}
+
+	resp := processPayload(&item.payload, tenant)
+	r.StatusCode = resp.StatusCode
+	r.Result = json.RawMessage(resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal([]byte(resp.Body), &body)
+		r.Error = body.Error
+		if r.Error == "" {
+			r.Error = http.StatusText(resp.StatusCode)
+		}
+		logger.ERROR("failed to process batch item", tag.NewStringTag("id", r.ID), tag.NewStringTag("error", r.Error))
+	}
+	return r
+}
+
+// runBatchJob works through the manifest of a batch job a chunk at a time, storing its progress after
+// each. When the time budget runs out the job is queued again to carry on, and false is returned.
+func runBatchJob(store jobStore, j *job, b *batchRequest) (events.APIGatewayProxyResponse, bool) {
+	if err := b.checkBuckets(); err != nil {
+		return buildJSONResp(http.StatusBadRequest, map[string]interface{}{"error": err.Error()}), true
+	}
+	items, err := readManifest(b.Manifest)
+	if err != nil {
+		return buildErrorResp(err), true
+	}
+	output := b.Output
+	if output == "" {
+		output = strings.TrimSuffix(b.Manifest, ".json") + ".results"
+	}
+	outBucket, outPrefix, err := parseS3URI(output)
+	if err != nil {
+		return buildJSONResp(http.StatusBadRequest, map[string]interface{}{"error": err.Error()}), true
+	}
+
+	if j.Batch == nil {
+		j.Batch = &batchProgress{Total: len(items)}
+	}
+	budget := defaultBatchTimeBudget
+	if d, err := time.ParseDuration(os.Getenv("BATCH_TIME_BUDGET")); err == nil && d > 0 {
+		budget = d
+	}
+
+	start := time.Now()
+	for j.Batch.Processed < len(items) {
+		if time.Since(start) > budget {
+			_, queue := jobsFor()
+			if err := queue.Send(j.ID); err != nil {
+				return buildErrorResp(fmt.Errorf("failed to queue the rest of the batch: %v", err)), true
+			}
+			logger.INFO("continuing batch job", tag.NewStringTag("jobId", j.ID), tag.NewAnyTag("processed", j.Batch.Processed))
+			return events.APIGatewayProxyResponse{}, false
+		}
+
+		end := j.Batch.Processed + batchChunkSize
+		if end > len(items) {
+			end = len(items)
+		}
+		results := runBatch(items[j.Batch.Processed:end], j.Batch.Processed, b.Concurrency, j.Tenant)
+
+		var buf bytes.Buffer
+		for _, r := range results {
+			line, _ := json.Marshal(r)
+			buf.Write(line)
+			buf.WriteByte('\n')
+			if r.Error == "" {
+				j.Batch.Succeeded++
+			} else {
+				j.Batch.Failed++
+			}
+		}
+		key := fmt.Sprintf("%s/part-%05d.jsonl", strings.TrimSuffix(outPrefix, "/"), len(j.Batch.Parts)+1)
+		if err := uploadToS3(outBucket, key, buf.Bytes(), "application/x-ndjson"); err != nil {
+			return buildErrorResp(fmt.Errorf("failed to upload batch results: %v", err)), true
+		}
+
+		j.Batch.Parts = append(j.Batch.Parts, fmt.Sprintf("s3://%s/%s", outBucket, key))
+		j.Batch.Processed = end
+		j.UpdatedAt = time.Now().UTC()
+		if err := store.Put(j); err != nil {
+			return buildErrorResp(fmt.Errorf("failed to update job: %v", err)), true
+		}
+	}
+
+	return buildJSONResp(http.StatusOK, map[string]interface{}{
+		"total":     j.Batch.Total,
+		"succeeded": j.Batch.Succeeded,
+		"failed":    j.Batch.Failed,
+		"parts":     j.Batch.Parts,
+	}), true
+}
+
+// readManifest reads the items of a manifest, a json array or json lines.
+func readManifest(uri string) ([]batchItem, error) {
+	bucket, key, err := parseS3URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	b, err := downloadFromS3(bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return parseManifest(b)
+}
+
+func parseManifest(b []byte) ([]batchItem, error) {
+	b = bytes.TrimSpace(b)
+	var items []batchItem
+	if bytes.HasPrefix(b, []byte("[")) {
+		if err := json.Unmarshal(b, &items); err != nil {
+			return nil, fmt.Errorf("failed to decode manifest: %v", err)
+		}
+		return items, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		item := batchItem{}
+		if err := json.Unmarshal(line, &item); err != nil {
+			return nil, fmt.Errorf("failed to decode manifest line %d: %v", n, err)
+		}
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return items, nil
+}
+
+// parseS3URI splits an s3://bucket/key uri.
+func parseS3URI(uri string) (string, string, error) {
+	rest := strings.TrimPrefix(uri, "s3://")
+	parts := strings.SplitN(rest, "/", 2)
+	if rest == uri || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid s3 uri: %s", uri)
+	}
+	return parts[0], parts[1], nil
+}
+
+func downloadFromS3(bucket string, key string) ([]byte, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String("ap-south-1"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+
+	out, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %v", err)
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
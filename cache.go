@@ -0,0 +1,333 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bureau-Inc/overwatch-common/logger"
+	"github.com/Bureau-Inc/overwatch-common/logger/tag"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	cacheStoreDynamoDB = "dynamodb"
+	cacheStoreFile     = "file"
+	cacheStoreMemory   = "memory"
+	cacheStoreNone     = "none"
+
+	defaultOCRCacheTTL    = 24 * time.Hour
+	defaultResultCacheTTL = time.Hour
+	// the memory cache drops its least recently used values beyond this size, CACHE_MEMORY_BYTES changes it
+	defaultMemoryCacheBytes = 64 << 20
+
+	ocrCachePrefix    = "ocr#"
+	resultCachePrefix = "result#"
+)
+
+// cacheStore keeps values until their ttl runs out.
+type cacheStore interface {
+	Get(key string) ([]byte, bool, error)
+	Put(key string, value []byte, ttl time.Duration) error
+}
+
+var (
+	cacheOnce    sync.Once
+	defaultCache cacheStore
+)
+
+// cacheFor returns the store set by CACHE_STORE, dynamodb with the CACHE_TABLE table in production, file
+// under CACHE_DIR or memory locally, and none to turn caching off. Without CACHE_STORE the table or the
+// directory decides, memory being the default. Nil is returned when caching is off.
+func cacheFor() cacheStore {
+	cacheOnce.Do(func() {
+		store := strings.ToLower(os.Getenv("CACHE_STORE"))
+		if store == "" {
+			switch {
+			case os.Getenv("CACHE_TABLE") != "":
+				store = cacheStoreDynamoDB
+			case os.Getenv("CACHE_DIR") != "":
+				store = cacheStoreFile
+			default:
+				store = cacheStoreMemory
+			}
+		}
+
+		switch store {
+		case cacheStoreDynamoDB:
+			defaultCache = &dynamoCache{table: os.Getenv("CACHE_TABLE")}
+		case cacheStoreFile:
+			dir := os.Getenv("CACHE_DIR")
+			if dir == "" {
+				dir = filepath.Join(os.TempDir(), "nergpt-cache")
+			}
+			defaultCache = &fileCache{dir: dir}
+		case cacheStoreMemory:
+			limit := defaultMemoryCacheBytes
+			if n, err := strconv.Atoi(os.Getenv("CACHE_MEMORY_BYTES")); err == nil && n > 0 {
+				limit = n
+			}
+			defaultCache = newMemoryCache(limit)
+		case cacheStoreNone:
+		default:
+			logger.ERROR("unsupported cache store, caching is off", tag.NewStringTag("store", store))
+		}
+	})
+	return defaultCache
+}
+
+func cacheTTL(env string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(env)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+func sha256Hex(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ocrCacheKey identifies an ocr run by the exact image bytes sent to the engine and how it was called.
+func ocrCacheKey(engine string, model string, docType string, image []byte) string {
+	return ocrCachePrefix + sha256Hex([]byte(engine), []byte(model), []byte(docType), image)
+}
+
+// resultCacheKey identifies an extraction by the submitted image, what was asked of it and the prompts
+// used. The options and the engines, modes and model they resolved to are part of it as they change the
+// fields and their details.
+func resultCacheKey(image []byte, docType string, outputFields string, opts analysisOptions, settings ...string) string {
+	opts.NoCache = false
+	o, _ := json.Marshal(opts)
+	parts := [][]byte{sha256Sum(image), []byte(docType), []byte(outputFields), []byte(promptVersion), o}
+	for _, s := range settings {
+		parts = append(parts, []byte(s))
+	}
+	return resultCachePrefix + sha256Hex(parts...)
+}
+
+func sha256Sum(b []byte) []byte {
+	s := sha256.Sum256(b)
+	return s[:]
+}
+
+// cacheGet decodes the cached value into v and tells whether there was one. Cache errors are logged and
+// treated as a miss, the cache never fails a request.
+func cacheGet(store cacheStore, key string, v interface{}) bool {
+	if store == nil {
+		return false
+	}
+	b, ok, err := store.Get(key)
+	if err != nil {
+		logger.ERROR("failed to read cache", tag.NewStringTag("key", key), tag.NewErrorTag(err))
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		logger.ERROR("failed to decode cached value", tag.NewStringTag("key", key), tag.NewErrorTag(err))
+		return false
+	}
+	return true
+}
+
+func cachePut(store cacheStore, key string, v interface{}, ttl time.Duration) {
+	if store == nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.ERROR("failed to encode cache value", tag.NewStringTag("key", key), tag.NewErrorTag(err))
+		return
+	}
+	if err := store.Put(key, b, ttl); err != nil {
+		logger.ERROR("failed to write cache", tag.NewStringTag("key", key), tag.NewErrorTag(err))
+	}
+}
+
+type memoryItem struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// memoryCache lives as long as the process, across the invocations of a warm lambda. It holds up to
+// limit bytes of values, dropping the least recently used ones first.
+type memoryCache struct {
+	mu    sync.Mutex
+	limit int
+	size  int
+	// order has the most recently used item at the front
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newMemoryCache(limit int) *memoryCache {
+	return &memoryCache{limit: limit, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	item := e.Value.(*memoryItem)
+	if time.Now().After(item.expiresAt) {
+		c.remove(e)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(e)
+	return item.value, true, nil
+}
+
+func (c *memoryCache) Put(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	if len(value) > c.limit {
+		return nil
+	}
+	c.items[key] = c.order.PushFront(&memoryItem{key: key, value: value, expiresAt: time.Now().Add(ttl)})
+	c.size += len(value)
+	for c.size > c.limit {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+func (c *memoryCache) remove(e *list.Element) {
+	item := c.order.Remove(e).(*memoryItem)
+	delete(c.items, item.key)
+	c.size -= len(item.value)
+}
+
+type fileItem struct {
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// fileCache keeps one json file per key, so that the cache survives restarts of local runs. The values
+// hold the text and fields of identity documents, only the user running the service can read them.
+type fileCache struct {
+	dir string
+}
+
+func (c *fileCache) path(key string) string {
+	return filepath.Join(c.dir, strings.Replace(key, "#", "-", 1)+".json")
+}
+
+func (c *fileCache) Get(key string) ([]byte, bool, error) {
+	b, err := os.ReadFile(c.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read cache file: %v", err)
+	}
+
+	item := &fileItem{}
+	if err := json.Unmarshal(b, item); err != nil {
+		return nil, false, fmt.Errorf("failed to decode cache file: %v", err)
+	}
+	if time.Now().After(item.ExpiresAt) {
+		os.Remove(c.path(key))
+		return nil, false, nil
+	}
+	return item.Value, true, nil
+}
+
+func (c *fileCache) Put(key string, value []byte, ttl time.Duration) error {
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cache dir: %v", err)
+	}
+	b, err := json.Marshal(fileItem{ExpiresAt: time.Now().Add(ttl), Value: value})
+	if err != nil {
+		return fmt.Errorf("failed to encode cache file: %v", err)
+	}
+	return os.WriteFile(c.path(key), b, 0o600)
+}
+
+// dynamoCache keeps the values in a table with a "key" string hash key. expiresAt is meant to be the ttl
+// attribute of the table, it is checked on read as well since dynamodb removes expired items late.
+type dynamoCache struct {
+	table string
+}
+
+func (c *dynamoCache) client() (*dynamodb.DynamoDB, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String("ap-south-1"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	return dynamodb.New(sess), nil
+}
+
+func (c *dynamoCache) Get(key string) ([]byte, bool, error) {
+	svc, err := c.client()
+	if err != nil {
+		return nil, false, err
+	}
+
+	out, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(c.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key": {S: aws.String(key)},
+		},
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get cache item: %v", err)
+	}
+	if out.Item == nil || out.Item["value"] == nil {
+		return nil, false, nil
+	}
+
+	if exp := out.Item["expiresAt"]; exp != nil && exp.N != nil {
+		expiresAt, err := strconv.ParseInt(aws.StringValue(exp.N), 10, 64)
+		if err == nil && time.Now().Unix() > expiresAt {
+			return nil, false, nil
+		}
+	}
+	return out.Item["value"].B, true, nil
+}
+
+func (c *dynamoCache) Put(key string, value []byte, ttl time.Duration) error {
+	svc, err := c.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(c.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"key":       {S: aws.String(key)},
+			"value":     {B: value},
+			"expiresAt": {N: aws.String(strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put cache item: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/aws/aws-sdk-go/service/rekognition/rekognitioniface"
+)
+
+const (
+	cassetteRecord = "record"
+	cassetteReplay = "replay"
+
+	// cassetteSuffix holds the recorded provider calls of a fixture name.json
+	cassetteSuffix = ".cassette.json"
+
+	scrubbed = "REDACTED"
+
+	// request bodies up to this size are kept readable in the cassette, larger ones only by their hash
+	maxRecordedRequestBody = 64 << 10
+)
+
+// httpClient makes every call to azure, the llm and the image hosts, so that they can be recorded.
+var httpClient = http.DefaultClient
+
+// newRekognitionClient returns the client fetchOCRAnalysisResultfromAWS calls.
+var newRekognitionClient = func() (rekognitioniface.RekognitionAPI, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String("ap-south-1"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	return rekognition.New(sess), nil
+}
+
+// sleep waits for the providers, replays skip the waits.
+var sleep = time.Sleep
+
+// secretPattern matches the names of headers and query parameters that carry credentials.
+var secretPattern = regexp.MustCompile(`(?i)key|token|secret|signature|sig$|password|authorization|cookie|credential|^code$`)
+
+// cassette holds the provider calls of one recorded run. Replays answer each call with the first
+// unused recording of the same request, so that repeated polls get the answers in the recorded order.
+type cassette struct {
+	HTTP        []*httpInteraction        `json:"http"`
+	Rekognition []*rekognitionInteraction `json:"rekognition"`
+
+	mu   sync.Mutex
+	mode string
+}
+
+// httpInteraction is a request, told apart by its method, url and body hash, and its response. Neither
+// the request headers nor secret response headers and query parameters are kept.
+type httpInteraction struct {
+	Method        string            `json:"method"`
+	URL           string            `json:"url"`
+	RequestSHA256 string            `json:"requestSha256"`
+	RequestBody   string            `json:"requestBody,omitempty"`
+	StatusCode    int               `json:"statusCode"`
+	Header        map[string]string `json:"header"`
+	Body          string            `json:"body"`
+	BodyBase64    bool              `json:"bodyBase64,omitempty"`
+
+	used bool
+}
+
+type rekognitionInteraction struct {
+	ImageSHA256 string                        `json:"imageSha256"`
+	Output      *rekognition.DetectTextOutput `json:"output"`
+
+	used bool
+}
+
+func loadCassette(path string) (*cassette, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %v", err)
+	}
+	c := &cassette{mode: cassetteReplay}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("failed to decode cassette: %v", err)
+	}
+	return c, nil
+}
+
+func (c *cassette) save(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cassette: %v", err)
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// useCassette routes the provider clients through the cassette until the returned func restores them.
+func useCassette(c *cassette) func() {
+	prevClient, prevRekognition, prevSleep := httpClient, newRekognitionClient, sleep
+
+	httpClient = &http.Client{Transport: &cassetteTransport{c: c, next: http.DefaultTransport}}
+	newRekognitionClient = func() (rekognitioniface.RekognitionAPI, error) {
+		r := &recordedRekognition{c: c}
+		if c.mode == cassetteRecord {
+			svc, err := prevRekognition()
+			if err != nil {
+				return nil, err
+			}
+			r.RekognitionAPI = svc
+		}
+		return r, nil
+	}
+	if c.mode == cassetteReplay {
+		sleep = func(time.Duration) {}
+	}
+
+	return func() {
+		httpClient, newRekognitionClient, sleep = prevClient, prevRekognition, prevSleep
+	}
+}
+
+type cassetteTransport struct {
+	c    *cassette
+	next http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %v", err)
+		}
+		body = b
+	}
+	u := scrubURL(req.URL)
+	sum := hex.EncodeToString(sha256Sum(body))
+
+	if t.c.mode == cassetteReplay {
+		in := t.c.findHTTP(req.Method, u, sum)
+		if in == nil {
+			return nil, fmt.Errorf("no recorded response for %s %s", req.Method, u)
+		}
+		return in.response(req)
+	}
+
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	in := &httpInteraction{
+		Method:        req.Method,
+		URL:           u,
+		RequestSHA256: sum,
+		StatusCode:    resp.StatusCode,
+		Header:        map[string]string{},
+	}
+	if len(body) <= maxRecordedRequestBody && utf8.Valid(body) {
+		in.RequestBody = string(body)
+	}
+	for k := range resp.Header {
+		if !secretPattern.MatchString(k) {
+			in.Header[k] = resp.Header.Get(k)
+		}
+	}
+	if utf8.Valid(respBody) {
+		in.Body = string(respBody)
+	} else {
+		in.Body, in.BodyBase64 = base64.StdEncoding.EncodeToString(respBody), true
+	}
+
+	t.c.mu.Lock()
+	t.c.HTTP = append(t.c.HTTP, in)
+	t.c.mu.Unlock()
+	return resp, nil
+}
+
+func (c *cassette) findHTTP(method string, u string, sum string) *httpInteraction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, in := range c.HTTP {
+		if !in.used && in.Method == method && in.URL == u && in.RequestSHA256 == sum {
+			in.used = true
+			return in
+		}
+	}
+	return nil
+}
+
+func (in *httpInteraction) response(req *http.Request) (*http.Response, error) {
+	body := []byte(in.Body)
+	if in.BodyBase64 {
+		b, err := base64.StdEncoding.DecodeString(in.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode recorded body: %v", err)
+		}
+		body = b
+	}
+
+	header := http.Header{}
+	for k, v := range in.Header {
+		header.Set(k, v)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.StatusCode, http.StatusText(in.StatusCode)),
+		StatusCode:    in.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// scrubURL replaces the values of secret query parameters, e.g. the signature of a presigned url.
+func scrubURL(u *url.URL) string {
+	q := u.Query()
+	if len(q) == 0 {
+		return u.String()
+	}
+	for k := range q {
+		if secretPattern.MatchString(k) {
+			q.Set(k, scrubbed)
+		}
+	}
+	out := *u
+	out.RawQuery = q.Encode()
+	return out.String()
+}
+
+// recordedRekognition answers DetectText from the cassette, recording the answers of the real client
+// when the cassette is recording. Every other call goes to the real client.
+type recordedRekognition struct {
+	rekognitioniface.RekognitionAPI
+	c *cassette
+}
+
+func (r *recordedRekognition) DetectText(input *rekognition.DetectTextInput) (*rekognition.DetectTextOutput, error) {
+	var image []byte
+	if input.Image != nil {
+		image = input.Image.Bytes
+	}
+	sum := hex.EncodeToString(sha256Sum(image))
+
+	if r.c.mode == cassetteReplay {
+		r.c.mu.Lock()
+		defer r.c.mu.Unlock()
+		for _, in := range r.c.Rekognition {
+			if !in.used && in.ImageSHA256 == sum {
+				in.used = true
+				return in.Output, nil
+			}
+		}
+		return nil, fmt.Errorf("no recorded rekognition response for image %s", sum)
+	}
+
+	out, err := r.RekognitionAPI.DetectText(input)
+	if err != nil {
+		return nil, err
+	}
+	r.c.mu.Lock()
+	r.c.Rekognition = append(r.c.Rekognition, &rekognitionInteraction{ImageSHA256: sum, Output: out})
+	r.c.mu.Unlock()
+	return out, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// allowLocalFiles lets fetchImage read file:// urls, only the cli turns it on.
+var allowLocalFiles bool
+
+// dumpFn receives the ocr text of each engine, the llm prompts and the llm responses when set.
+var dumpFn func(kind string, label string, text string)
+
+func dump(kind string, label string, text string) {
+	if dumpFn != nil {
+		dumpFn(kind, label, text)
+	}
+}
+
+// runExtract runs the analysis of local files or urls through the same pipeline as HandleRequest, e.g.
+// nergpt extract --type pan --front card.jpg --output table.
+func runExtract(args []string) int {
+	fs := flag.NewFlagSet("extract", flag.ContinueOnError)
+	docType := fs.String("type", "", "document type, pan or aadhar, empty for any document with --fields")
+	front := fs.String("front", "", "front of the document, a local file or an http or s3 url")
+	back := fs.String("back", "", "back of the document, analysed the same way as the front")
+	fields := fs.String("fields", "", "comma separated fields to print, the fields to extract for other documents")
+	output := fs.String("output", "json", "json or table")
+	out := fs.String("out", "", "file to write the output to instead of stdout")
+	engines := fs.String("engines", "", "comma separated ocr engines, e.g. azure,textract or tesseract to run offline")
+	awsEngine := fs.String("aws-engine", "", "aws engine compared against azure, rekognition or textract")
+	fallback := fs.String("fallback", "", "engine replacing one that fails")
+	azureModel := fs.String("azure-model", "", "azure model overriding the one of the doc type")
+	ensemble := fs.Bool("ensemble", false, "vote the ocr engines into one consensus text")
+	llmMode := fs.String("llm-mode", "", "per-engine, combined or compare")
+	extractor := fs.String("extractor", "", "llm, hybrid or rules")
+	skipQuality := fs.Bool("skip-quality-check", false, "run ocr even on blurry or badly lit images")
+	noCache := fs.Bool("no-cache", false, "run the ocr and the llm again for documents seen before")
+	dumpOCR := fs.Bool("dump-ocr", false, "print the ocr text of each engine to stderr")
+	dumpPrompts := fs.Bool("dump-prompts", false, "print the llm prompts and responses to stderr")
+	tenant := fs.String("tenant", "cli", "tenant the usage is reported for")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *front == "" {
+		fmt.Fprintln(os.Stderr, "--front is required")
+		fs.Usage()
+		return 2
+	}
+	if *output != "json" && *output != "table" {
+		fmt.Fprintf(os.Stderr, "unsupported output: %s\n", *output)
+		return 2
+	}
+
+	allowLocalFiles = true
+	allowAnyS3Bucket = true
+	metricsOut = io.Discard
+	if *dumpOCR || *dumpPrompts {
+		var mu sync.Mutex
+		dumpFn = func(kind string, label string, text string) {
+			if (kind == "ocr" && !*dumpOCR) || (kind != "ocr" && !*dumpPrompts) {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(os.Stderr, "=== %s: %s ===\n%s\n\n", kind, label, text)
+		}
+		// cached results skip the steps worth dumping
+		*noCache = true
+	}
+
+	input := payload{
+		DocType:          strings.ToUpper(*docType),
+		AzureModel:       *azureModel,
+		AWSEngine:        *awsEngine,
+		FallbackEngine:   *fallback,
+		LLMMode:          *llmMode,
+		Extractor:        *extractor,
+		SkipQualityCheck: *skipQuality,
+		NoCache:          *noCache,
+	}
+	if input.DocType == "AADHAAR" {
+		input.DocType = aadharDoc
+	}
+	if *engines != "" {
+		input.OCREngines = splitList(*engines)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "ensemble" {
+			input.Ensemble = ensemble
+		}
+	})
+	var keep []string
+	if input.DocType == "" || input.DocType == unknownDoc {
+		input.OutputFields = *fields
+	} else if *fields != "" {
+		keep = splitList(*fields)
+	}
+
+	sides := []string{"front"}
+	urls := map[string]string{"front": *front}
+	if *back != "" {
+		sides = append(sides, "back")
+		urls["back"] = *back
+	}
+
+	results := map[string]map[string]interface{}{}
+	failed := false
+	for _, side := range sides {
+		url, err := localURL(urls[side])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		in := input
+		in.FrontURL = url
+		resp := processPayload(&in, *tenant)
+
+		body := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to decode %s result: %v\n", side, err)
+			return 1
+		}
+		if resp.StatusCode != http.StatusOK {
+			fmt.Fprintf(os.Stderr, "failed to extract the %s: %d %s\n", side, resp.StatusCode, resp.Body)
+			failed = true
+			continue
+		}
+		results[side] = filterFields(body, keep)
+	}
+
+	if len(results) == 0 {
+		return 1
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create output file: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *output == "table" {
+		writeFieldTable(w, sides, results)
+	} else {
+		var v interface{} = results
+		if len(sides) == 1 {
+			v = results["front"]
+		}
+		b, _ := json.MarshalIndent(v, "", "  ")
+		fmt.Fprintln(w, string(b))
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// localURL turns a local path into a file:// url, urls are left as they are.
+func localURL(s string) (string, error) {
+	if strings.Contains(s, "://") {
+		return s, nil
+	}
+	abs, err := filepath.Abs(s)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", s, err)
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", s, err)
+	}
+	return "file://" + abs, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// filterFields keeps the listed fields and the meta of the result, every field when none are listed.
+func filterFields(body map[string]interface{}, keep []string) map[string]interface{} {
+	if len(keep) == 0 || body == nil {
+		return body
+	}
+	out := map[string]interface{}{}
+	for _, k := range keep {
+		if v, ok := body[k]; ok {
+			out[k] = v
+		}
+	}
+	if meta, ok := body["_meta"]; ok {
+		out["_meta"] = meta
+	}
+	return out
+}
+
+// writeFieldTable prints one row per field of each side, leaving the meta out.
+func writeFieldTable(w io.Writer, sides []string, results map[string]map[string]interface{}) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	if len(sides) > 1 {
+		fmt.Fprintln(tw, "SIDE\tFIELD\tVALUE")
+	} else {
+		fmt.Fprintln(tw, "FIELD\tVALUE")
+	}
+	for _, side := range sides {
+		body := results[side]
+		keys := make([]string, 0, len(body))
+		for k := range body {
+			if k != "_meta" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			value := ""
+			switch v := body[k].(type) {
+			case nil:
+			case string:
+				value = v
+			default:
+				b, _ := json.Marshal(v)
+				value = string(b)
+			}
+			if len(sides) > 1 {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", side, k, value)
+			} else {
+				fmt.Fprintf(tw, "%s\t%s\n", k, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Bureau-Inc/overwatch-common/logger"
+	"github.com/Bureau-Inc/overwatch-common/logger/tag"
+)
+
+// engineRun is the result of one ocr engine on the document.
+type engineRun struct {
+	Engine string
+	Doc    *ocrDocument
+	// Score is the combined confidence of the words normalized to 0-10
+	Score float64
+	// Azure is the raw result, only set for the azure engine
+	Azure *AnalyzeResult
+	// Model is the model or api of the engine that was called and Pages the number of pages it billed
+	Model string
+	Pages int
+	// Cached is set when the run was served from the cache, nothing was billed for it
+	Cached bool `json:"-"`
+}
+
+var ocrEngines = map[string]bool{
+	engineAzure:       true,
+	engineRekognition: true,
+	engineTextract:    true,
+	engineTesseract:   true,
+}
+
+// ocrEnginesFor returns the engines to run, taken from the request, then OCR_ENGINES, then azure along with
+// the aws engine. OCR_ENGINES=tesseract runs the service without any cloud ocr credentials.
+func ocrEnginesFor(override []string, awsEngine string) ([]string, error) {
+	engines := override
+	if len(engines) == 0 {
+		if env := os.Getenv("OCR_ENGINES"); env != "" {
+			engines = strings.Split(env, ",")
+		}
+	}
+	if len(engines) == 0 {
+		aws, err := awsEngineFor(awsEngine)
+		if err != nil {
+			return nil, err
+		}
+		engines = []string{engineAzure, aws}
+	}
+
+	var unique []string
+	seen := map[string]bool{}
+	for _, e := range engines {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if !ocrEngines[e] {
+			return nil, fmt.Errorf("unsupported ocr engine: %s", e)
+		}
+		if !seen[e] {
+			seen[e] = true
+			unique = append(unique, e)
+		}
+	}
+	return unique, nil
+}
+
+// fallbackEngineFor returns the engine that replaces a failed one, OCR_FALLBACK_ENGINE sets the default.
+func fallbackEngineFor(override string) (string, error) {
+	engine := strings.ToLower(override)
+	if engine == "" {
+		engine = strings.ToLower(os.Getenv("OCR_FALLBACK_ENGINE"))
+	}
+	if engine != "" && !ocrEngines[engine] {
+		return "", fmt.Errorf("unsupported fallback ocr engine: %s", engine)
+	}
+	return engine, nil
+}
+
+// ocrRunner runs the engines of one request. An engine that fails is replaced by the fallback engine,
+// unless the fallback already ran, so that one provider outage does not fail the request.
+type ocrRunner struct {
+	docType  string
+	model    string
+	fallback string
+	used     map[string]bool
+	// runs are cached by the image bytes sent, noCache only skips the lookup
+	store   cacheStore
+	noCache bool
+}
+
+func newOCRRunner(engines []string, docType string, model string, fallback string, store cacheStore, noCache bool) *ocrRunner {
+	used := map[string]bool{}
+	for _, e := range engines {
+		used[e] = true
+	}
+	return &ocrRunner{docType: docType, model: model, fallback: fallback, used: used, store: store, noCache: noCache}
+}
+
+func (r *ocrRunner) run(engine string, img *preparedImage) (*engineRun, error) {
+	run, err := r.cachedRun(engine, img)
+	if err == nil {
+		return run, nil
+	}
+	if r.fallback == "" || r.used[r.fallback] {
+		return nil, err
+	}
+
+	logger.ERROR("ocr engine failed, using fallback", tag.NewStringTag("engine", engine), tag.NewStringTag("fallback", r.fallback), tag.NewErrorTag(err))
+	r.used[r.fallback] = true
+	return r.cachedRun(r.fallback, img)
+}
+
+func (r *ocrRunner) cachedRun(engine string, img *preparedImage) (*engineRun, error) {
+	key := ocrCacheKey(engine, r.model, r.docType, img.Bytes)
+	cached := &engineRun{}
+	if !r.noCache && cacheGet(r.store, key, cached) {
+		logger.INFO("using cached ocr result", tag.NewStringTag("engine", engine), tag.NewStringTag("key", key))
+		cached.Cached = true
+		return cached, nil
+	}
+
+	run, err := runOCREngine(engine, img, r.docType, r.model)
+	if err != nil {
+		return nil, err
+	}
+	cachePut(r.store, key, run, cacheTTL("OCR_CACHE_TTL", defaultOCRCacheTTL))
+	return run, nil
+}
+
+func runOCREngine(engine string, img *preparedImage, docType string, model string) (*engineRun, error) {
+	if stubs != nil {
+		return stubs.ocr(engine, img)
+	}
+
+	run := &engineRun{Engine: engine}
+	waitForProvider(engine)
+	switch engine {
+	case engineAzure:
+		analysisReqID, err := submitOCRAnalysis(img.Bytes, model)
+		if err != nil {
+			return nil, fmt.Errorf("failed to submit ocr analysis: %v", err)
+		}
+
+		sleep(2 * time.Second)
+
+		result, err := waitForOCRAnalysisResult(analysisReqID, model)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch ocr analysis result: %v", err)
+		}
+		run.Azure = &result.AnalyzeResult
+		run.Doc = normalizeAzureResult(run.Azure, img)
+		run.Model, run.Pages = model, len(run.Azure.Pages)
+		run.Score = fetchCombinedNormalizedConfidenceScoreForAzure(run.Azure)
+		return run, nil
+	case engineRekognition:
+		resultfromaws, err := fetchOCRAnalysisResultfromAWS(img.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch ocr analysis result from aws: %v", err)
+		}
+		run.Doc = normalizeRekognitionResult(resultfromaws, img)
+		run.Model, run.Pages = "DetectText", 1
+	case engineTextract:
+		blocks, err := fetchOCRAnalysisResultfromTextract(img.Bytes, docType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch ocr analysis result from textract: %v", err)
+		}
+		run.Doc = normalizeTextractBlocks(blocks, img)
+		run.Model, run.Pages = textractAPIFor(docType), 1
+	case engineTesseract:
+		tsv, err := fetchOCRAnalysisResultfromTesseract(img.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch ocr analysis result from tesseract: %v", err)
+		}
+		run.Doc = normalizeTesseractTSV(tsv, img)
+		run.Pages = 1
+	default:
+		return nil, fmt.Errorf("unsupported ocr engine: %s", engine)
+	}
+
+	run.Score = fetchCombinedNormalizedConfidenceScore(run.Doc)
+	return run, nil
+}
+
+// azureRun returns the run of the azure engine, nil when azure did not run.
+func azureRun(runs []*engineRun) *engineRun {
+	for _, r := range runs {
+		if r.Azure != nil {
+			return r
+		}
+	}
+	return nil
+}
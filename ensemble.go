@@ -0,0 +1,411 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	engineEnsemble = "ensemble"
+
+	// a word is kept when the engines that read it carry at least this share of the total engine weight
+	minEnsembleSupport = 0.3
+	// a word of another engine joins a cluster when this much of it lies within the cluster box
+	minEnsembleOverlap = 0.5
+)
+
+// ensembleAlternate is a word the engines disagreed on, with the readings that lost the vote.
+type ensembleAlternate struct {
+	Text       string    `json:"text"`
+	Alternates []string  `json:"alternates"`
+	Page       int       `json:"page"`
+	Polygon    []float64 `json:"polygon"`
+}
+
+// ensembleCandidate is the reading of a word cluster by one engine.
+type ensembleCandidate struct {
+	engine string
+	text   string
+	// weight is the engine weight times the mean word confidence, trust the engine weight alone
+	weight float64
+	trust  float64
+	words  []ocrWord
+}
+
+// wordCluster is a group of words of different engines lying at the same place on the page.
+type wordCluster struct {
+	page     int
+	box      []float64
+	line     string
+	byEngine map[string][]ocrWord
+}
+
+// engineWeights returns the reliability weight of each engine, 1 unless OCR_ENGINE_WEIGHTS sets it, e.g.
+// OCR_ENGINE_WEIGHTS=azure=1.2,tesseract=0.6.
+func engineWeights() map[string]float64 {
+	weights := map[string]float64{}
+	for _, pair := range strings.Split(os.Getenv("OCR_ENGINE_WEIGHTS"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if w, err := strconv.ParseFloat(parts[1], 64); err == nil && w > 0 {
+			weights[strings.ToLower(parts[0])] = w
+		}
+	}
+	return weights
+}
+
+func engineWeight(weights map[string]float64, engine string) float64 {
+	if w, ok := weights[engine]; ok {
+		return w
+	}
+	return 1
+}
+
+// ensembleDocuments aligns the words of every engine by position and votes on each word character by
+// character, weighted by engine weight and word confidence. It returns the consensus document and the
+// words the engines disagreed on.
+func ensembleDocuments(runs []*engineRun, docs []*ocrDocument) (*ocrDocument, []ensembleAlternate) {
+	weights := engineWeights()
+
+	// the most trusted engine goes first so that its words shape the clusters
+	order := make([]int, len(runs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		wa := engineWeight(weights, runs[order[a]].Engine) * runs[order[a]].Score
+		wb := engineWeight(weights, runs[order[b]].Engine) * runs[order[b]].Score
+		return wa > wb
+	})
+
+	var clusters []*wordCluster
+	totalWeight := 0.0
+	for _, i := range order {
+		engine := runs[i].Engine
+		totalWeight += engineWeight(weights, engine)
+		for li, l := range docs[i].Lines {
+			for _, w := range l.Words {
+				box := boundingPolygon(w.Polygon)
+				c := findCluster(clusters, w.Page, box)
+				if c == nil {
+					c = &wordCluster{
+						page:     w.Page,
+						box:      box,
+						line:     engine + "/" + strconv.Itoa(li),
+						byEngine: map[string][]ocrWord{},
+					}
+					clusters = append(clusters, c)
+				}
+				c.byEngine[engine] = append(c.byEngine[engine], w)
+			}
+		}
+	}
+
+	var lines []ocrLine
+	lineIndex := map[string]int{}
+	var alternates []ensembleAlternate
+	offset := 0
+	for _, c := range clusters {
+		var candidates []ensembleCandidate
+		support := 0.0
+		for _, i := range order {
+			words := c.byEngine[runs[i].Engine]
+			if len(words) == 0 {
+				continue
+			}
+			ew := engineWeight(weights, runs[i].Engine)
+			support += ew
+			candidates = append(candidates, ensembleCandidate{
+				engine: runs[i].Engine,
+				text:   joinWords(words),
+				weight: ew * meanConfidence(words),
+				trust:  ew,
+				words:  words,
+			})
+		}
+		if totalWeight == 0 || support/totalWeight < minEnsembleSupport {
+			continue
+		}
+
+		text, agreement := voteCharacters(candidates)
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		word := ocrWord{
+			Content:    text,
+			Confidence: agreement * bestConfidence(candidates),
+			Page:       c.page,
+			Polygon:    c.box,
+			Offset:     offset,
+			Length:     len(text),
+		}
+		for _, cand := range candidates {
+			for _, w := range cand.words {
+				word.Handwritten = word.Handwritten || w.Handwritten
+			}
+		}
+
+		idx, ok := lineIndex[c.line]
+		if !ok {
+			idx = len(lines)
+			lineIndex[c.line] = idx
+			lines = append(lines, ocrLine{Page: c.page})
+		}
+		lines[idx].Words = append(lines[idx].Words, word)
+		offset += len(text) + 1
+
+		if alt := alternatesOf(text, candidates); len(alt) > 0 {
+			alternates = append(alternates, ensembleAlternate{Text: text, Alternates: alt, Page: c.page, Polygon: c.box})
+		}
+	}
+
+	for i := range lines {
+		var polygons [][]float64
+		for _, w := range lines[i].Words {
+			polygons = append(polygons, w.Polygon)
+		}
+		lines[i].Polygon = boundingPolygon(polygons...)
+	}
+
+	return newOCRDocument(engineEnsemble, lines), alternates
+}
+
+func findCluster(clusters []*wordCluster, page int, box []float64) *wordCluster {
+	var best *wordCluster
+	bestOverlap := 0.0
+	for _, c := range clusters {
+		if c.page != page {
+			continue
+		}
+		overlap := overlapRatio(box, c.box)
+		if o := overlapRatio(c.box, box); o > overlap {
+			overlap = o
+		}
+		if overlap >= minEnsembleOverlap && overlap > bestOverlap {
+			best, bestOverlap = c, overlap
+		}
+	}
+	return best
+}
+
+// voteCharacters aligns every candidate to the heaviest one and votes on each character and on what lies
+// between characters. It returns the winning text and the mean share of the weight that agreed with it.
+func voteCharacters(candidates []ensembleCandidate) (string, float64) {
+	if len(candidates) == 0 {
+		return "", 0
+	}
+
+	// readings of equal weight go to the most trusted engine, then the most confident one, so that the
+	// same runs always vote the same text
+	rank := make([]int, len(candidates))
+	for i := range rank {
+		rank[i] = i
+	}
+	sort.SliceStable(rank, func(a, b int) bool {
+		ca, cb := candidates[rank[a]], candidates[rank[b]]
+		if ca.trust != cb.trust {
+			return ca.trust > cb.trust
+		}
+		return ca.weight/ca.trust > cb.weight/cb.trust
+	})
+	preference := make([]int, len(candidates))
+	for p, i := range rank {
+		preference[i] = p
+	}
+
+	pivot := 0
+	for i, c := range candidates {
+		w := candidates[pivot].weight
+		if c.weight > w || (c.weight == w && preference[i] < preference[pivot]) {
+			pivot = i
+		}
+	}
+	ref := []rune(candidates[pivot].text)
+
+	// slot 2*i is what is inserted before ref[i], slot 2*i+1 is what stands at ref[i]
+	slots := make([]map[string]float64, 2*len(ref)+1)
+	// best holds the preference of the most preferred candidate voting each reading of a slot
+	best := make([]map[string]int, len(slots))
+	for i := range slots {
+		slots[i] = map[string]float64{}
+		best[i] = map[string]int{}
+	}
+	vote := func(slot int, reading string, c int) {
+		slots[slot][reading] += candidates[c].weight
+		if p, ok := best[slot][reading]; !ok || preference[c] < p {
+			best[slot][reading] = preference[c]
+		}
+	}
+	total := 0.0
+	for ci, c := range candidates {
+		total += c.weight
+		subs, ins := alignRunes(ref, []rune(c.text))
+		for i := range ref {
+			vote(2*i, ins[i], ci)
+			vote(2*i+1, subs[i], ci)
+		}
+		vote(2*len(ref), ins[len(ref)], ci)
+	}
+
+	var sb strings.Builder
+	agreement, voted := 0.0, 0
+	for i, slot := range slots {
+		winner, weight := "", -1.0
+		// the pivot reading wins ties
+		pivotReading := ""
+		if i%2 == 1 {
+			pivotReading = string(ref[i/2])
+		}
+		for s, w := range slot {
+			switch {
+			case w > weight:
+			case w < weight || winner == pivotReading:
+				continue
+			case s != pivotReading && best[i][s] > best[i][winner]:
+				continue
+			}
+			winner, weight = s, w
+		}
+		sb.WriteString(winner)
+		if i%2 == 1 || winner != "" {
+			voted++
+			if total > 0 {
+				agreement += weight / total
+			}
+		}
+	}
+	if voted == 0 {
+		return sb.String(), 0
+	}
+	return strings.Join(strings.Fields(sb.String()), " "), agreement / float64(voted)
+}
+
+// alignRunes aligns b against a with the least edits. subs[i] is what b has in place of a[i], empty when
+// it dropped it, and ins[i] what b has inserted before a[i], ins[len(a)] being what it has after the end.
+func alignRunes(a, b []rune) (subs []string, ins []string) {
+	n, m := len(a), len(b)
+	dist := make([][]int, n+1)
+	for i := range dist {
+		dist[i] = make([]int, m+1)
+		dist[i][0] = i
+	}
+	for j := 0; j <= m; j++ {
+		dist[0][j] = j
+	}
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := dist[i-1][j-1] + cost
+			if dist[i-1][j]+1 < d {
+				d = dist[i-1][j] + 1
+			}
+			if dist[i][j-1]+1 < d {
+				d = dist[i][j-1] + 1
+			}
+			dist[i][j] = d
+		}
+	}
+
+	subs = make([]string, n)
+	insRunes := make([][]rune, n+1)
+	i, j := n, m
+	for i > 0 || j > 0 {
+		switch {
+		case i > 0 && j > 0 && dist[i][j] == dist[i-1][j-1]+boolCost(a[i-1] != b[j-1]):
+			subs[i-1] = string(b[j-1])
+			i, j = i-1, j-1
+		case i > 0 && dist[i][j] == dist[i-1][j]+1:
+			i--
+		default:
+			insRunes[i] = append([]rune{b[j-1]}, insRunes[i]...)
+			j--
+		}
+	}
+
+	ins = make([]string, n+1)
+	for k, r := range insRunes {
+		ins[k] = string(r)
+	}
+	return subs, ins
+}
+
+func boolCost(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func joinWords(words []ocrWord) string {
+	parts := make([]string, 0, len(words))
+	for _, w := range words {
+		parts = append(parts, w.Content)
+	}
+	return strings.Join(parts, " ")
+}
+
+func meanConfidence(words []ocrWord) float64 {
+	if len(words) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, w := range words {
+		sum += w.Confidence
+	}
+	return sum / float64(len(words))
+}
+
+// bestConfidence is the highest confidence any engine had in its reading.
+func bestConfidence(candidates []ensembleCandidate) float64 {
+	best := 0.0
+	for _, c := range candidates {
+		if m := meanConfidence(c.words); m > best {
+			best = m
+		}
+	}
+	return best
+}
+
+// alternatesOf returns the distinct readings that differ from the consensus, heaviest first.
+func alternatesOf(text string, candidates []ensembleCandidate) []string {
+	sorted := make([]ensembleCandidate, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].weight > sorted[j].weight
+	})
+
+	var alternates []string
+	seen := map[string]bool{normalizeForMatch(text): true}
+	for _, c := range sorted {
+		key := normalizeForMatch(c.text)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		alternates = append(alternates, c.text)
+	}
+	return alternates
+}
+
+// withAlternates appends the readings the engines disagreed on to the ocr text, so that the llm can
+// consider them when the consensus reading looks wrong for a field.
+func withAlternates(text string, alternates []ensembleAlternate) string {
+	if len(alternates) == 0 {
+		return text
+	}
+	var sb strings.Builder
+	sb.WriteString(text)
+	sb.WriteString("\n[alternative readings]")
+	for _, a := range alternates {
+		sb.WriteString("\n" + a.Text + " | " + strings.Join(a.Alternates, " | "))
+	}
+	return sb.String()
+}
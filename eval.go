@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+)
+
+const (
+	evalAllGroup  = "all"
+	evalAllFields = "*"
+
+	defaultEngineSet = "default"
+)
+
+// evalCase is a labelled document of a dataset, one json object per line:
+// {"id": "pan-001", "docType": "pan", "image": "images/pan-001.jpg", "expected": {"fullName": "..."}}.
+// The image is relative to the dataset unless it is a url, a null expected field is one the document does
+// not have. Payload sets any other option of the request.
+type evalCase struct {
+	ID       string                 `json:"id"`
+	DocType  string                 `json:"docType"`
+	Image    string                 `json:"image"`
+	Expected map[string]interface{} `json:"expected"`
+	Payload  json.RawMessage        `json:"payload"`
+}
+
+// evalReport is the outcome of a run over a dataset, kept as json to compare runs.
+type evalReport struct {
+	Dataset   string                `json:"dataset"`
+	CreatedAt time.Time             `json:"createdAt"`
+	Groups    map[string]*evalGroup `json:"groups"`
+	Items     []*evalItem           `json:"items"`
+}
+
+type evalItem struct {
+	ID         string                `json:"id"`
+	DocType    string                `json:"docType"`
+	Engines    string                `json:"engines"`
+	StatusCode int                   `json:"statusCode"`
+	Error      string                `json:"error,omitempty"`
+	Cost       float64               `json:"cost"`
+	Fields     map[string]*evalField `json:"fields"`
+	// Cached is set when the ocr or the whole analysis came from the cache, Cost is then not what a
+	// fresh run costs
+	Cached bool `json:"cached,omitempty"`
+}
+
+type evalField struct {
+	Expected   interface{} `json:"expected"`
+	Got        interface{} `json:"got"`
+	Exact      bool        `json:"exact"`
+	Normalized bool        `json:"normalized"`
+	// Edits is the character edit distance from the expected value, of Chars characters
+	Edits int `json:"edits"`
+	Chars int `json:"chars"`
+}
+
+// evalGroup adds up the items of a doc type, an engine set or the whole run. Fields has the metrics of
+// each field and of all fields together under "*". MeanCost leaves the cached items out.
+type evalGroup struct {
+	Items    int                      `json:"items"`
+	Errors   int                      `json:"errors"`
+	Cached   int                      `json:"cached"`
+	Cost     float64                  `json:"cost"`
+	MeanCost float64                  `json:"meanCost"`
+	Fields   map[string]*fieldMetrics `json:"fields"`
+}
+
+// fieldMetrics compare the extracted values with the labels. A null value is the positive class of the
+// null precision and recall, so that they tell how well the pipeline leaves out what is not there.
+type fieldMetrics struct {
+	Count          int     `json:"count"`
+	Exact          int     `json:"exact"`
+	Normalized     int     `json:"normalized"`
+	ExactRate      float64 `json:"exactRate"`
+	NormalizedRate float64 `json:"normalizedRate"`
+	Edits          int     `json:"edits"`
+	Chars          int     `json:"chars"`
+	CER            float64 `json:"cer"`
+	NullTP         int     `json:"nullTp"`
+	NullFP         int     `json:"nullFp"`
+	NullFN         int     `json:"nullFn"`
+	NullPrecision  float64 `json:"nullPrecision"`
+	NullRecall     float64 `json:"nullRecall"`
+}
+
+// evalUsage documents both forms of the command, the flags follow.
+const evalUsage = `usage:
+  nergpt eval [flags] dataset.jsonl
+      runs the pipeline over a labelled dataset and reports its accuracy and cost
+  nergpt eval compare base.json run.json
+      prints the metrics of two reports written with --out side by side
+a dataset file named compare is given as ./compare
+`
+
+// runEval runs the pipeline over a labelled dataset and reports its accuracy and cost, e.g.
+// nergpt eval --engines azure,textract --out run.json dataset.jsonl, or compares two reports with
+// nergpt eval compare base.json run.json.
+func runEval(args []string) int {
+	if len(args) > 0 && args[0] == "compare" {
+		return runEvalCompare(args[1:])
+	}
+
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), evalUsage+"\nflags:\n")
+		fs.PrintDefaults()
+	}
+	engines := fs.String("engines", defaultEngineSet, "comma separated engine sets to run every document with, engines of a set joined by +, e.g. azure,azure+rekognition")
+	out := fs.String("out", "", "file to write the report to")
+	concurrency := fs.Int("concurrency", defaultBatchConcurrency, "documents processed at a time")
+	noCache := fs.Bool("no-cache", true, "run the ocr and the llm again for documents seen before, --no-cache=false reuses cached results, which are counted as cached and left out of the mean cost")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "give the dataset to evaluate")
+		fs.Usage()
+		return 2
+	}
+	dataset := fs.Arg(0)
+
+	cases, err := readEvalDataset(dataset)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	allowLocalFiles = true
+	allowAnyS3Bucket = true
+	metricsOut = io.Discard
+
+	type task struct {
+		c       *evalCase
+		engines string
+	}
+	var tasks []task
+	for _, set := range splitList(*engines) {
+		for _, c := range cases {
+			tasks = append(tasks, task{c: c, engines: set})
+		}
+	}
+
+	items := make([]*evalItem, len(tasks))
+	sem := make(chan struct{}, batchConcurrency(*concurrency))
+	var wg sync.WaitGroup
+	for i := range tasks {
+		i := i
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			items[i] = evaluateCase(tasks[i].c, filepath.Dir(dataset), tasks[i].engines, *noCache)
+		}()
+	}
+	wg.Wait()
+
+	report := buildEvalReport(dataset, items)
+	writeEvalSummary(os.Stdout, report)
+
+	if *out != "" {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*out, append(b, '\n'), 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func readEvalDataset(path string) ([]*evalCase, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dataset: %v", err)
+	}
+
+	var cases []*evalCase
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		c := &evalCase{}
+		if err := json.Unmarshal(line, c); err != nil {
+			return nil, fmt.Errorf("failed to decode dataset line %d: %v", n, err)
+		}
+		if c.Image == "" || len(c.Expected) == 0 {
+			return nil, fmt.Errorf("dataset line %d needs an image and expected fields", n)
+		}
+		if c.ID == "" {
+			c.ID = fmt.Sprintf("%d", n)
+		}
+		cases = append(cases, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dataset: %v", err)
+	}
+	return cases, nil
+}
+
+// evaluateCase runs the case with the engine set and compares the fields with the labels. A document that
+// fails counts as missing every field.
+func evaluateCase(c *evalCase, dir string, engines string, noCache bool) *evalItem {
+	item := &evalItem{ID: c.ID, DocType: strings.ToUpper(c.DocType), Engines: engines, Fields: map[string]*evalField{}}
+	if item.DocType == "" {
+		item.DocType = unknownDoc
+	}
+
+	body, err := runEvalCase(c, dir, engines, noCache, item)
+	if err != nil {
+		item.Error = err.Error()
+	}
+	for name, expected := range c.Expected {
+		item.Fields[name] = compareField(expected, body[name])
+	}
+	return item
+}
+
+func runEvalCase(c *evalCase, dir string, engines string, noCache bool, item *evalItem) (map[string]interface{}, error) {
+	input := &payload{}
+	if len(c.Payload) > 0 {
+		if err := json.Unmarshal(c.Payload, input); err != nil {
+			return nil, fmt.Errorf("failed to decode payload: %v", err)
+		}
+	}
+	input.DocType = c.DocType
+	input.NoCache = input.NoCache || noCache
+	if engines != defaultEngineSet {
+		input.OCREngines = strings.Split(engines, "+")
+	}
+	image := c.Image
+	if !strings.Contains(image, "://") && !filepath.IsAbs(image) {
+		image = filepath.Join(dir, image)
+	}
+	url, err := localURL(image)
+	if err != nil {
+		return nil, err
+	}
+	input.FrontURL = url
+	if item.DocType == unknownDoc && input.OutputFields == "" {
+		keys := make([]string, 0, len(c.Expected))
+		for k := range c.Expected {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		input.OutputFields = strings.Join(keys, ",")
+	}
+
+	resp := processPayload(input, "eval")
+	item.StatusCode = resp.StatusCode
+	body := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v", body["error"])
+	}
+
+	if meta, ok := body["_meta"].(map[string]interface{}); ok {
+		item.Cached, _ = meta["cached"].(bool)
+		if usage, ok := meta["usage"].(map[string]interface{}); ok {
+			item.Cost, _ = usage["totalCost"].(float64)
+			if runs, _ := usage["cachedOcrRuns"].(float64); runs > 0 {
+				item.Cached = true
+			}
+		}
+	}
+	return body, nil
+}
+
+func compareField(expected interface{}, got interface{}) *evalField {
+	f := &evalField{Expected: expected, Got: got}
+	want, have := fieldString(expected), fieldString(got)
+	f.Exact = want == have
+	f.Normalized = normalizeField(want) == normalizeField(have)
+	if want != "" {
+		f.Edits = editDistance([]rune(strings.ToUpper(want)), []rune(strings.ToUpper(have)))
+		f.Chars = len([]rune(want))
+	}
+	return f
+}
+
+// fieldString is the value as text, empty for null and for the markers the pipeline uses for a missing
+// value, e.g. "nil".
+func fieldString(v interface{}) string {
+	if isMissingValue(v) {
+		return ""
+	}
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// normalizeField keeps the letters and digits, upper cased, so that 03/02/1998 matches 03-02-1998 and
+// case or spacing differences of names do not count.
+func normalizeField(s string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+func editDistance(a []rune, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func buildEvalReport(dataset string, items []*evalItem) *evalReport {
+	r := &evalReport{Dataset: dataset, CreatedAt: time.Now().UTC(), Groups: map[string]*evalGroup{}, Items: items}
+	group := func(key string) *evalGroup {
+		g, ok := r.Groups[key]
+		if !ok {
+			g = &evalGroup{Fields: map[string]*fieldMetrics{}}
+			r.Groups[key] = g
+		}
+		return g
+	}
+
+	uncachedCost := map[*evalGroup]float64{}
+	for _, item := range items {
+		for _, g := range []*evalGroup{group(evalAllGroup), group("docType:" + item.DocType), group("engines:" + item.Engines)} {
+			g.Items++
+			g.Cost += item.Cost
+			if item.Error != "" {
+				g.Errors++
+			}
+			if item.Cached {
+				g.Cached++
+			} else {
+				uncachedCost[g] += item.Cost
+			}
+			for name, f := range item.Fields {
+				for _, key := range []string{name, evalAllFields} {
+					m, ok := g.Fields[key]
+					if !ok {
+						m = &fieldMetrics{}
+						g.Fields[key] = m
+					}
+					m.add(f)
+				}
+			}
+		}
+	}
+
+	for _, g := range r.Groups {
+		g.Cost = roundCost(g.Cost)
+		if n := g.Items - g.Cached; n > 0 {
+			g.MeanCost = roundCost(uncachedCost[g] / float64(n))
+		}
+		for _, m := range g.Fields {
+			m.finish()
+		}
+	}
+	return r
+}
+
+func (m *fieldMetrics) add(f *evalField) {
+	m.Count++
+	if f.Exact {
+		m.Exact++
+	}
+	if f.Normalized {
+		m.Normalized++
+	}
+	m.Edits += f.Edits
+	m.Chars += f.Chars
+
+	wantNull, gotNull := fieldString(f.Expected) == "", fieldString(f.Got) == ""
+	switch {
+	case wantNull && gotNull:
+		m.NullTP++
+	case gotNull:
+		m.NullFP++
+	case wantNull:
+		m.NullFN++
+	}
+}
+
+func (m *fieldMetrics) finish() {
+	m.ExactRate = ratio(m.Exact, m.Count)
+	m.NormalizedRate = ratio(m.Normalized, m.Count)
+	m.CER = ratio(m.Edits, m.Chars)
+	m.NullPrecision = ratio(m.NullTP, m.NullTP+m.NullFP)
+	m.NullRecall = ratio(m.NullTP, m.NullTP+m.NullFN)
+}
+
+func ratio(a int, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return math.Round(float64(a)/float64(b)*1e4) / 1e4
+}
+
+// writeEvalSummary prints the metrics of every group and field.
+func writeEvalSummary(w io.Writer, r *evalReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintln(tw, "GROUP\tFIELD\tCOUNT\tEXACT\tNORMALIZED\tCER\tNULL P\tNULL R\tERRORS\tCACHED\tMEAN COST")
+	for _, key := range sortedKeys(r.Groups) {
+		g := r.Groups[key]
+		for _, name := range sortedFieldKeys(g.Fields) {
+			m := g.Fields[name]
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%.4f\t%.4f\t%.4f\t%.4f\t%.4f\t%d\t%d\t%.6f\n",
+				key, name, m.Count, m.ExactRate, m.NormalizedRate, m.CER, m.NullPrecision, m.NullRecall, g.Errors, g.Cached, g.MeanCost)
+		}
+		if len(g.Fields) == 0 {
+			fmt.Fprintf(tw, "%s\t%s\t0\t-\t-\t-\t-\t-\t%d\t%d\t%.6f\n", key, evalAllFields, g.Errors, g.Cached, g.MeanCost)
+		}
+	}
+}
+
+// runEvalCompare prints the metrics of a second report next to the ones of a first, with the change.
+func runEvalCompare(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, "give the base and the new report\n"+evalUsage)
+		return 2
+	}
+	base, err := readEvalReport(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	run, err := readEvalReport(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	writeEvalComparison(os.Stdout, base, run)
+	return 0
+}
+
+func readEvalReport(path string) (*evalReport, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report: %v", err)
+	}
+	r := &evalReport{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("failed to decode report %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// writeEvalComparison prints a row per group, field and metric. Groups and fields missing from one of the
+// reports show as -.
+func writeEvalComparison(w io.Writer, base *evalReport, run *evalReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	groups := map[string]*evalGroup{}
+	for k, g := range base.Groups {
+		groups[k] = g
+	}
+	for k, g := range run.Groups {
+		groups[k] = g
+	}
+
+	fmt.Fprintln(tw, "GROUP\tFIELD\tMETRIC\tBASE\tNEW\tCHANGE")
+	for _, key := range sortedKeys(groups) {
+		a, b := base.Groups[key], run.Groups[key]
+		cost := func(g *evalGroup) *float64 {
+			if g == nil {
+				return nil
+			}
+			return &g.MeanCost
+		}
+		errs := func(g *evalGroup) *float64 {
+			if g == nil {
+				return nil
+			}
+			v := float64(g.Errors)
+			return &v
+		}
+		cached := func(g *evalGroup) *float64 {
+			if g == nil {
+				return nil
+			}
+			v := float64(g.Cached)
+			return &v
+		}
+		writeComparisonRow(tw, key, "", "mean cost", "%.6f", cost(a), cost(b))
+		writeComparisonRow(tw, key, "", "errors", "%.0f", errs(a), errs(b))
+		writeComparisonRow(tw, key, "", "cached", "%.0f", cached(a), cached(b))
+
+		fields := map[string]*fieldMetrics{}
+		for _, g := range []*evalGroup{a, b} {
+			if g == nil {
+				continue
+			}
+			for k, m := range g.Fields {
+				fields[k] = m
+			}
+		}
+		for _, name := range sortedFieldKeys(fields) {
+			ma, mb := groupField(a, name), groupField(b, name)
+			for _, metric := range []struct {
+				name  string
+				value func(m *fieldMetrics) float64
+			}{
+				{"exact", func(m *fieldMetrics) float64 { return m.ExactRate }},
+				{"normalized", func(m *fieldMetrics) float64 { return m.NormalizedRate }},
+				{"cer", func(m *fieldMetrics) float64 { return m.CER }},
+				{"null precision", func(m *fieldMetrics) float64 { return m.NullPrecision }},
+				{"null recall", func(m *fieldMetrics) float64 { return m.NullRecall }},
+			} {
+				value := func(m *fieldMetrics) *float64 {
+					if m == nil {
+						return nil
+					}
+					v := metric.value(m)
+					return &v
+				}
+				writeComparisonRow(tw, key, name, metric.name, "%.4f", value(ma), value(mb))
+			}
+		}
+	}
+}
+
+func groupField(g *evalGroup, name string) *fieldMetrics {
+	if g == nil {
+		return nil
+	}
+	return g.Fields[name]
+}
+
+// writeComparisonRow prints the values with the format, a nil value being missing from its report.
+func writeComparisonRow(w io.Writer, group string, field string, metric string, format string, from *float64, to *float64) {
+	cell := func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprintf(format, *v)
+	}
+	change := "-"
+	if from != nil && to != nil {
+		change = fmt.Sprintf(strings.Replace(format, "%", "%+", 1), *to-*from)
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", group, field, metric, cell(from), cell(to), change)
+}
+
+// sortedKeys puts the whole run first, then the doc types and the engine sets.
+func sortedKeys(groups map[string]*evalGroup) []string {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i] == evalAllGroup) != (keys[j] == evalAllGroup) {
+			return keys[i] == evalAllGroup
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// sortedFieldKeys puts all fields together first, then each field.
+func sortedFieldKeys(fields map[string]*fieldMetrics) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i] == evalAllFields) != (keys[j] == evalAllFields) {
+			return keys[i] == evalAllFields
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
@@ -0,0 +1,129 @@
+package main
+
+import "math"
+
+const (
+	handwritingFlag    = "flag"
+	handwritingExclude = "exclude"
+
+	// azure reports a confidence for every style, below this the handwriting claim is ignored
+	minHandwritingConfidence = 0.5
+)
+
+// handwrittenSpans returns the spans azure is confident are handwritten.
+func handwrittenSpans(result *AnalyzeResult) []Span {
+	var spans []Span
+	for _, s := range result.Styles {
+		if s.IsHandwritten && s.Confidence >= minHandwritingConfidence {
+			spans = append(spans, s.Spans...)
+		}
+	}
+	return spans
+}
+
+func inSpans(offset int, length int, spans []Span) bool {
+	for _, s := range spans {
+		if offset >= s.Offset && offset+length <= s.Offset+s.Length {
+			return true
+		}
+	}
+	return false
+}
+
+// handwritingRatio is the share of the document content that is handwritten.
+func handwritingRatio(result *AnalyzeResult) float64 {
+	if result == nil {
+		return 0
+	}
+	total := 0
+	for _, p := range result.Pages {
+		for _, s := range p.Spans {
+			total += s.Length
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+
+	handwritten := 0
+	for _, s := range handwrittenSpans(result) {
+		handwritten += s.Length
+	}
+	return math.Round(float64(handwritten)/float64(total)*100) / 100
+}
+
+// handwrittenBoxes returns the bounding boxes of the words azure found to be handwritten.
+func handwrittenBoxes(azureDoc *ocrDocument) [][]float64 {
+	if azureDoc == nil {
+		return nil
+	}
+	var boxes [][]float64
+	for _, w := range azureDoc.Words {
+		if w.Handwritten {
+			boxes = append(boxes, boundingPolygon(w.Polygon))
+		}
+	}
+	return boxes
+}
+
+// isHandwritten tells whether the word is handwritten, either as detected by its own engine or by lying
+// over a word azure found to be handwritten.
+func isHandwritten(w ocrWord, boxes [][]float64) bool {
+	if w.Handwritten {
+		return true
+	}
+	box := boundingPolygon(w.Polygon)
+	for _, h := range boxes {
+		if overlapRatio(box, h) > 0.5 {
+			return true
+		}
+	}
+	return false
+}
+
+// flagHandwrittenFields marks the fields whose words are handwritten.
+func flagHandwrittenFields(details map[string]*fieldDetail, azureDoc *ocrDocument) {
+	boxes := handwrittenBoxes(azureDoc)
+	for _, d := range details {
+		for _, w := range d.words {
+			if isHandwritten(w, boxes) {
+				d.Handwritten = true
+				break
+			}
+		}
+	}
+}
+
+// withoutHandwriting returns a copy of the document without its handwritten words, such as signatures,
+// so that the llm does not mistake them for printed values. Words of engines that do not detect
+// handwriting are compared by position against the handwritten words of azure.
+func withoutHandwriting(doc *ocrDocument, azureDoc *ocrDocument) *ocrDocument {
+	boxes := handwrittenBoxes(azureDoc)
+	lines := make([]ocrLine, 0, len(doc.Lines))
+	for _, l := range doc.Lines {
+		printed := ocrLine{Page: l.Page, Polygon: l.Polygon}
+		for _, w := range l.Words {
+			if !isHandwritten(w, boxes) {
+				printed.Words = append(printed.Words, w)
+			}
+		}
+		if len(printed.Words) > 0 {
+			lines = append(lines, printed)
+		}
+	}
+	return newOCRDocument(doc.Engine, lines)
+}
+
+// overlapRatio is the share of box a covered by box b, both given as bounding polygons.
+func overlapRatio(a, b []float64) float64 {
+	if a == nil || b == nil {
+		return 0
+	}
+	w := math.Min(a[4], b[4]) - math.Max(a[0], b[0])
+	h := math.Min(a[5], b[5]) - math.Max(a[1], b[1])
+	area := (a[4] - a[0]) * (a[5] - a[1])
+	if w <= 0 || h <= 0 || area <= 0 {
+		return 0
+	}
+	return w * h / area
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bureau-Inc/overwatch-common/logger"
+	"github.com/Bureau-Inc/overwatch-common/logger/tag"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	// jobFailed is retried by sqs when the failure was on the side of the service or a provider, up to
+	// JOBS_MAX_ATTEMPTS runs. A job failing on its input is not run again.
+	jobFailed = "failed"
+
+	defaultJobTTL = 7 * 24 * time.Hour
+	// keep it below the maxReceiveCount of the queue, so that the job ends failed before the message goes
+	// to the dead letter queue
+	defaultJobMaxAttempts = 3
+
+	jobsPath = "/jobs"
+
+	// handlerJobs is the HANDLER of the lambda consuming the jobs queue
+	handlerJobs = "jobs"
+
+	// maxJobItemBytes keeps the encoded job below the 400KB item limit of dynamodb, with room for the
+	// attribute types it adds
+	maxJobItemBytes = 350 << 10
+)
+
+// job is an analysis run in the background. Result is the body the synchronous api would have returned
+// and StatusCode its status.
+type job struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Kind is empty for a single payload and batch for a manifest
+	Kind       string          `json:"kind,omitempty"`
+	Tenant     string          `json:"tenant"`
+	Payload    json.RawMessage `json:"payload"`
+	StatusCode int             `json:"statusCode,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	// ResultS3URI holds the result instead when it is too large for the jobs table
+	ResultS3URI string    `json:"resultS3Uri,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Attempts    int       `json:"attempts"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	// CallbackStatus and Deliveries record the webhook sent to the callbackUrl of the payload
+	CallbackStatus string            `json:"callbackStatus,omitempty"`
+	Deliveries     []webhookDelivery `json:"deliveries,omitempty"`
+	Batch          *batchProgress    `json:"batch,omitempty"`
+	// ExpiresAt is in unix seconds, the ttl attribute of the jobs table
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+type jobMessage struct {
+	JobID string `json:"jobId"`
+}
+
+type jobStore interface {
+	Put(j *job) error
+	// Get returns nil when there is no such job
+	Get(id string) (*job, error)
+}
+
+type jobQueue interface {
+	Send(id string) error
+}
+
+var (
+	jobsOnce        sync.Once
+	defaultJobStore jobStore
+	defaultJobQueue jobQueue
+)
+
+// jobsFor returns the job store and queue, dynamodb with the JOBS_TABLE table and sqs with JOBS_QUEUE_URL
+// in production. Without them jobs are kept in memory and run in the background of the same process,
+// which is enough for local runs and tests.
+func jobsFor() (jobStore, jobQueue) {
+	jobsOnce.Do(func() {
+		if table := os.Getenv("JOBS_TABLE"); table != "" {
+			defaultJobStore = &dynamoJobStore{table: table, resultBucket: os.Getenv("JOBS_RESULT_BUCKET")}
+		} else {
+			defaultJobStore = &memoryJobStore{jobs: map[string]job{}}
+		}
+
+		if url := os.Getenv("JOBS_QUEUE_URL"); url != "" {
+			defaultJobQueue = &sqsJobQueue{url: url}
+		} else {
+			defaultJobQueue = localJobQueue{}
+		}
+	})
+	return defaultJobStore, defaultJobQueue
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate job id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// jobIDOf returns the id of a GET /jobs/{id} request, empty for any other path.
+func jobIDOf(req events.APIGatewayProxyRequest) string {
+	if id := req.PathParameters["id"]; id != "" {
+		return id
+	}
+	if i := strings.Index(req.Path, jobsPath+"/"); i >= 0 {
+		return strings.Trim(req.Path[i+len(jobsPath)+1:], "/")
+	}
+	return ""
+}
+
+func isJobsPath(path string) bool {
+	return strings.HasSuffix(strings.TrimRight(path, "/"), jobsPath)
+}
+
+// submitJob queues the payload to be analysed in the background.
+func submitJob(req events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	input := &payload{}
+	if err := json.Unmarshal([]byte(req.Body), input); err != nil {
+		return buildBadRequestResp(fmt.Errorf("failed to unmarshal input:%v", err))
+	}
+	if input.CallbackURL != "" {
+		if err := validateCallbackURL(input.CallbackURL); err != nil {
+			return buildJSONResp(http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		}
+	}
+	return queueJob("", req.Body, tenantOf(req))
+}
+
+// queueJob stores the body as a queued job of the kind and hands it to the queue, answering with the job id.
+func queueJob(kind string, body string, tenant string) events.APIGatewayProxyResponse {
+	id, err := newJobID()
+	if err != nil {
+		return buildErrorResp(err)
+	}
+	now := time.Now().UTC()
+	j := &job{
+		ID:        id,
+		Status:    jobQueued,
+		Kind:      kind,
+		Tenant:    tenant,
+		Payload:   json.RawMessage(body),
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(defaultJobTTL).Unix(),
+	}
+
+	store, queue := jobsFor()
+	if err := store.Put(j); err != nil {
+		logger.ERROR("failed to store job", tag.NewErrorTag(err))
+		return buildErrorResp(fmt.Errorf("failed to store job: %v", err))
+	}
+	if err := queue.Send(id); err != nil {
+		logger.ERROR("failed to queue job", tag.NewErrorTag(err))
+		return buildErrorResp(fmt.Errorf("failed to queue job: %v", err))
+	}
+
+	logger.INFO("queued job", tag.NewStringTag("jobId", id))
+	return buildJobResp(http.StatusAccepted, j)
+}
+
+// getJob answers the job to the tenant that submitted it. Other tenants are told there is no such job,
+// the result holds the fields of an identity document.
+func getJob(id string, tenant string) events.APIGatewayProxyResponse {
+	store, _ := jobsFor()
+	j, err := store.Get(id)
+	if err != nil {
+		logger.ERROR("failed to get job", tag.NewStringTag("jobId", id), tag.NewErrorTag(err))
+		return buildErrorResp(fmt.Errorf("failed to get job: %v", err))
+	}
+	if j == nil || j.Tenant != tenant {
+		return buildJSONResp(http.StatusNotFound, map[string]interface{}{"error": "job not found"})
+	}
+	return buildJobResp(http.StatusOK, j)
+}
+
+// buildJobResp returns the job status, and its result once it completed. The payload is left out.
+func buildJobResp(statusCode int, j *job) events.APIGatewayProxyResponse {
+	d := map[string]interface{}{
+		"jobId":     j.ID,
+		"status":    j.Status,
+		"attempts":  j.Attempts,
+		"createdAt": j.CreatedAt,
+		"updatedAt": j.UpdatedAt,
+	}
+	if j.StatusCode != 0 {
+		d["statusCode"] = j.StatusCode
+	}
+	if len(j.Result) > 0 {
+		d["result"] = j.Result
+	}
+	if j.Error != "" {
+		d["error"] = j.Error
+	}
+	if j.Batch != nil {
+		d["batch"] = j.Batch
+	}
+	if j.CallbackStatus != "" {
+		d["callbackStatus"] = j.CallbackStatus
+		d["deliveries"] = j.Deliveries
+	}
+	return buildJSONResp(statusCode, d)
+}
+
+func buildJSONResp(statusCode int, d interface{}) events.APIGatewayProxyResponse {
+	b, _ := json.Marshal(d)
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body:            string(b),
+		IsBase64Encoded: false,
+	}
+}
+
+// processJob runs the analysis of a queued job and stores its result. A completed job is not run again
+// when sqs delivers its message twice, a batch job carries on from its progress. An error is returned for
+// failures worth retrying.
+func processJob(id string) error {
+	store, _ := jobsFor()
+	j, err := store.Get(id)
+	if err != nil {
+		return fmt.Errorf("failed to get job: %v", err)
+	}
+	if j == nil {
+		return fmt.Errorf("job %s not found", id)
+	}
+	if j.Status == jobCompleted {
+		logger.INFO("job already completed", tag.NewStringTag("jobId", id))
+		return nil
+	}
+
+	j.Status = jobRunning
+	j.Attempts++
+	j.UpdatedAt = time.Now().UTC()
+	if err := store.Put(j); err != nil {
+		return fmt.Errorf("failed to update job: %v", err)
+	}
+
+	var resp events.APIGatewayProxyResponse
+	var callbackURL string
+	switch j.Kind {
+	case jobKindBatch:
+		b := &batchRequest{}
+		if err := json.Unmarshal(j.Payload, b); err != nil {
+			resp = buildBadRequestResp(fmt.Errorf("failed to unmarshal batch job payload: %v", err))
+			break
+		}
+		var done bool
+		resp, done = runBatchJob(store, j, b)
+		if !done {
+			return nil
+		}
+		callbackURL = b.CallbackURL
+	default:
+		input := &payload{}
+		if err := json.Unmarshal(j.Payload, input); err != nil {
+			resp = buildBadRequestResp(fmt.Errorf("failed to unmarshal job payload: %v", err))
+			break
+		}
+		resp = processPayload(input, j.Tenant)
+		callbackURL = input.CallbackURL
+	}
+
+	j.StatusCode = resp.StatusCode
+	j.Result = json.RawMessage(resp.Body)
+	j.UpdatedAt = time.Now().UTC()
+	j.Status, j.Error = jobCompleted, ""
+	if resp.StatusCode >= http.StatusBadRequest {
+		j.Status = jobFailed
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal([]byte(resp.Body), &body)
+		j.Error = body.Error
+	}
+	if err := store.Put(j); err != nil {
+		return fmt.Errorf("failed to update job: %v", err)
+	}
+
+	if j.Status == jobFailed {
+		// server errors are worth another run, the input fails the same way every time
+		if resp.StatusCode >= http.StatusInternalServerError && j.Attempts < jobMaxAttempts() {
+			return fmt.Errorf("job %s failed: %s", id, j.Error)
+		}
+		logger.ERROR("job failed", tag.NewStringTag("jobId", id), tag.NewStringTag("error", j.Error))
+	} else {
+		logger.INFO("completed job", tag.NewStringTag("jobId", id))
+	}
+
+	if callbackURL != "" {
+		notifyJob(store, j, callbackURL)
+	}
+	return nil
+}
+
+func jobMaxAttempts() int {
+	if n, err := strconv.Atoi(os.Getenv("JOBS_MAX_ATTEMPTS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultJobMaxAttempts
+}
+
+// notifyJob posts the job to its callback url once it completed or failed for good, with its status and
+// error, and records the attempts on the job. A callback that is not delivered does not fail the job, its
+// result stays available from GET /jobs/{id}.
+func notifyJob(store jobStore, j *job, callbackURL string) {
+	body := buildJobResp(http.StatusOK, j).Body
+	deliveries, err := deliverWebhook(callbackURL, j.ID, []byte(body))
+
+	j.Deliveries = append(j.Deliveries, deliveries...)
+	j.CallbackStatus = webhookDelivered
+	if err != nil {
+		logger.ERROR("failed to deliver job callback", tag.NewStringTag("jobId", j.ID), tag.NewErrorTag(err))
+		j.CallbackStatus = webhookFailed
+	}
+	j.UpdatedAt = time.Now().UTC()
+	if err := store.Put(j); err != nil {
+		logger.ERROR("failed to record job callback", tag.NewStringTag("jobId", j.ID), tag.NewErrorTag(err))
+	}
+}
+
+// HandleJobQueue processes the jobs and payloads of an sqs batch, as many at a time as a batch request.
+// Only the messages that failed are reported back so that sqs retries them alone.
+func HandleJobQueue(event events.SQSEvent) (events.SQSEventResponse, error) {
+	resp := events.SQSEventResponse{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchConcurrency(0))
+	for _, record := range event.Records {
+		record := record
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := processQueueMessage(record); err != nil {
+				logger.ERROR("failed to process job message", tag.NewStringTag("messageId", record.MessageId), tag.NewErrorTag(err))
+				mu.Lock()
+				resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return resp, nil
+}
+
+type memoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]job
+}
+
+func (s *memoryJobStore) Put(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.ID] = *j
+	return nil
+}
+
+func (s *memoryJobStore) Get(id string) (*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	return &j, nil
+}
+
+// dynamoJobStore keeps the jobs in a table with an "id" string hash key. Results too large for an item
+// are written to resultBucket under jobs/<id>/result.json, or the job is failed without one.
+type dynamoJobStore struct {
+	table        string
+	resultBucket string
+}
+
+func (s *dynamoJobStore) client() (*dynamodb.DynamoDB, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String("ap-south-1"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	return dynamodb.New(sess), nil
+}
+
+func (s *dynamoJobStore) Put(j *job) error {
+	svc, err := s.client()
+	if err != nil {
+		return err
+	}
+	stored, err := s.fitItem(j)
+	if err != nil {
+		return err
+	}
+	item, err := dynamodbattribute.MarshalMap(stored)
+	if err != nil {
+		return fmt.Errorf("failed to encode job: %v", err)
+	}
+
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put job: %v", err)
+	}
+	return nil
+}
+
+// fitItem returns the job as it is stored, its result moved to s3 or dropped when the item would be over
+// the size limit. The job of the caller is left as it is, the webhook still gets the whole result.
+func (s *dynamoJobStore) fitItem(j *job) (*job, error) {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode job: %v", err)
+	}
+	if len(b) <= maxJobItemBytes || len(j.Result) == 0 {
+		return j, nil
+	}
+
+	stored := *j
+	stored.Result = nil
+	if s.resultBucket != "" {
+		key := "jobs/" + j.ID + "/result.json"
+		if err := uploadToS3(s.resultBucket, key, j.Result, "application/json"); err != nil {
+			return nil, fmt.Errorf("failed to upload job result: %v", err)
+		}
+		stored.ResultS3URI = fmt.Sprintf("s3://%s/%s", s.resultBucket, key)
+		return &stored, nil
+	}
+
+	logger.ERROR("job result is too large to store", tag.NewStringTag("jobId", j.ID), tag.NewAnyTag("bytes", len(j.Result)))
+	stored.Status = jobFailed
+	stored.StatusCode = http.StatusInternalServerError
+	stored.Error = fmt.Sprintf("result of %d bytes is too large to store, configure JOBS_RESULT_BUCKET to keep it", len(j.Result))
+	return &stored, nil
+}
+
+func (s *dynamoJobStore) Get(id string) (*job, error) {
+	svc, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(id)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job: %v", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	j := &job{}
+	if err := dynamodbattribute.UnmarshalMap(out.Item, j); err != nil {
+		return nil, fmt.Errorf("failed to decode job: %v", err)
+	}
+	if j.ResultS3URI != "" {
+		bucket, key, err := parseS3URI(j.ResultS3URI)
+		if err != nil {
+			return nil, err
+		}
+		if j.Result, err = downloadFromS3(bucket, key); err != nil {
+			return nil, fmt.Errorf("failed to download job result: %v", err)
+		}
+	}
+	return j, nil
+}
+
+type sqsJobQueue struct {
+	url string
+}
+
+func (q *sqsJobQueue) Send(id string) error {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String("ap-south-1"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+
+	b, _ := json.Marshal(jobMessage{JobID: id})
+	_, err = sqs.New(sess).SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.url),
+		MessageBody: aws.String(string(b)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send job message: %v", err)
+	}
+	return nil
+}
+
+// localJobQueue runs the job right away in the background, standing in for sqs outside aws.
+type localJobQueue struct{}
+
+func (localJobQueue) Send(id string) error {
+	go func() {
+		if err := processJob(id); err != nil {
+			logger.ERROR("failed to process job", tag.NewStringTag("jobId", id), tag.NewErrorTag(err))
+		}
+	}()
+	return nil
+}
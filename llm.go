@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Bureau-Inc/overwatch-common/logger"
+	"github.com/Bureau-Inc/overwatch-common/logger/tag"
+)
+
+const (
+	// llmModePerEngine asks the llm once per ocr engine and keeps the answer with most values
+	llmModePerEngine = "per-engine"
+	// llmModeCombined sends the output of every engine in one prompt and lets the llm reconcile them
+	llmModeCombined = "combined"
+	// llmModeCompare answers with per-engine and runs combined alongside to report how they differ
+	llmModeCompare = "compare"
+)
+
+// llmComparison reports how the combined call did against the per engine calls for the same document.
+// The costs are of the llm calls only, both modes read the same ocr results.
+type llmComparison struct {
+	PerEngineCalls      int                      `json:"perEngineCalls"`
+	CombinedCalls       int                      `json:"combinedCalls"`
+	PerEngineInputChars int                      `json:"perEngineInputChars"`
+	CombinedInputChars  int                      `json:"combinedInputChars"`
+	PerEngineTokens     int                      `json:"perEngineTokens"`
+	CombinedTokens      int                      `json:"combinedTokens"`
+	PerEngineCost       float64                  `json:"perEngineCost"`
+	CombinedCost        float64                  `json:"combinedCost"`
+	Currency            string                   `json:"currency"`
+	Agreement           float64                  `json:"agreement"`
+	Differences         map[string]llmDifference `json:"differences,omitempty"`
+	CombinedSources     map[string]string        `json:"combinedSources,omitempty"`
+}
+
+type llmDifference struct {
+	PerEngine interface{} `json:"perEngine"`
+	Combined  interface{} `json:"combined"`
+}
+
+// extraction is the outcome of the llm stage: the fields, the source they were taken from, best first,
+// and for the combined mode the source the llm trusted for every field.
+type extraction struct {
+	Fields       map[string]interface{}
+	Order        []int
+	FieldSources map[string]string
+	Calls        int
+	InputChars   int
+	Usage        Usage
+}
+
+func llmModeFor(override string) (string, error) {
+	mode := strings.ToLower(override)
+	if mode == "" {
+		mode = strings.ToLower(os.Getenv("LLM_MODE"))
+	}
+
+	switch mode {
+	case "", llmModePerEngine:
+		return llmModePerEngine, nil
+	case llmModeCombined, llmModeCompare:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unsupported llm mode: %s", override)
+}
+
+// extractPerEngine asks the llm for the fields of every source and keeps the answer with most values. If
+// several have the same number of values then the one with the higher confidence score is kept, a later
+// source winning a tie on score.
+func extractPerEngine(sources []*engineRun, texts []string, docType string, desiredFields string) (*extraction, error) {
+	ex := &extraction{}
+	candidates := make([]map[string]interface{}, 0, len(sources))
+	for i := range sources {
+		gptResultRaw, usage, err := askGPTForPIIAnalysis(texts[i], docType, desiredFields)
+		if err != nil {
+			return nil, fmt.Errorf("failed to ask gpt for PII analysis: %v", err)
+		}
+		ex.Calls++
+		ex.Usage = addUsage(ex.Usage, usage)
+		ex.InputChars += len(texts[i])
+
+		gptResultMap := map[string]interface{}{}
+		err = json.Unmarshal([]byte(gptResultRaw), &gptResultMap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode gpt result: %v", err)
+		}
+		candidates = append(candidates, gptResultMap)
+	}
+
+	best, bestCount := 0, -1
+	for i, c := range candidates {
+		count := 0
+		for _, v := range c {
+			if v != "nil" {
+				count++
+			}
+		}
+		logger.INFO(sources[i].Engine+" non null count", tag.NewAnyTag("count", count))
+
+		if count > bestCount || (count == bestCount && sources[i].Score >= sources[best].Score) {
+			best, bestCount = i, count
+		}
+	}
+	logger.INFO(sources[best].Engine + " result is selected")
+
+	ex.Fields = candidates[best]
+	ex.Order = []int{best}
+	for i := range sources {
+		if i != best {
+			ex.Order = append(ex.Order, i)
+		}
+	}
+	return ex, nil
+}
+
+// extractCombined sends the text of every source in a single prompt, each under a [source: <engine>]
+// header, and asks for every field along with the source it was read from.
+func extractCombined(sources []*engineRun, texts []string, docType string, desiredFields string) (*extraction, error) {
+	text := combinedOCRText(sources, texts)
+	gptResultRaw, usage, err := askGPTForPIIAnalysis(text, docType, desiredFields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ask gpt for PII analysis: %v", err)
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(gptResultRaw), &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode gpt result: %v", err)
+	}
+
+	fields, fieldSources := splitFieldSources(raw)
+	ex := &extraction{
+		Fields:       fields,
+		FieldSources: fieldSources,
+		Calls:        1,
+		InputChars:   len(text),
+		Usage:        usage,
+		Order:        trustOrder(sources, fieldSources),
+	}
+	logger.INFO(sources[ex.Order[0]].Engine+" is the most trusted source", tag.NewAnyTag("sources", fieldSources))
+	return ex, nil
+}
+
+func combinedOCRText(sources []*engineRun, texts []string) string {
+	var sb strings.Builder
+	sb.WriteString(combinedInstructions)
+	for i, s := range sources {
+		sb.WriteString("\n[source: " + s.Engine + "]\n")
+		sb.WriteString(texts[i])
+	}
+	return sb.String()
+}
+
+// combinedInstructions leads the ocr text of the combined prompt. It avoids double quotes as the ocr text
+// is placed in the prompt json as is.
+var combinedInstructions = `The document below was read by several OCR engines, the text of each starts with a [source: engine] line. ` +
+	`The engines make different mistakes, reconcile them to get every field right. ` +
+	`Return every key as an object with a value and the source engine you took it from, for example {'value': 'BWPPA3202G', 'source': 'azure'}.`
+
+// splitFieldSources separates the {"value", "source"} objects of the combined answer into the values and
+// the source of each field. Plain values are kept as they are, in case the llm ignored the format.
+func splitFieldSources(raw map[string]interface{}) (map[string]interface{}, map[string]string) {
+	fields := make(map[string]interface{}, len(raw))
+	sources := map[string]string{}
+	for k, v := range raw {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fields[k] = v
+			continue
+		}
+		value, ok := obj["value"]
+		if !ok || value == nil {
+			value = "nil"
+		}
+		fields[k] = value
+		if s, ok := obj["source"].(string); ok && s != "" && !isMissingValue(value) {
+			sources[k] = strings.ToLower(s)
+		}
+	}
+	return fields, sources
+}
+
+// trustOrder orders the sources by the number of fields the llm took from them, then by confidence score.
+func trustOrder(sources []*engineRun, fieldSources map[string]string) []int {
+	counts := map[string]int{}
+	for _, s := range fieldSources {
+		counts[s]++
+	}
+
+	order := make([]int, len(sources))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ca, cb := counts[sources[order[a]].Engine], counts[sources[order[b]].Engine]
+		if ca != cb {
+			return ca > cb
+		}
+		return sources[order[a]].Score > sources[order[b]].Score
+	})
+	return order
+}
+
+// compareExtractions reports the share of fields both modes agree on, the values where they do not and
+// what the llm calls of each mode cost.
+func compareExtractions(perEngine *extraction, combined *extraction, prices priceTable) *llmComparison {
+	c := &llmComparison{
+		PerEngineCalls:      perEngine.Calls,
+		CombinedCalls:       combined.Calls,
+		PerEngineInputChars: perEngine.InputChars,
+		CombinedInputChars:  combined.InputChars,
+		PerEngineTokens:     perEngine.Usage.TotalTokens,
+		CombinedTokens:      combined.Usage.TotalTokens,
+		PerEngineCost:       prices.llmCost(perEngine.Usage.PromptTokens, perEngine.Usage.CompletionTokens),
+		CombinedCost:        prices.llmCost(combined.Usage.PromptTokens, combined.Usage.CompletionTokens),
+		Currency:            prices.Currency,
+		Differences:         map[string]llmDifference{},
+		CombinedSources:     combined.FieldSources,
+	}
+
+	keys := map[string]bool{}
+	for k := range perEngine.Fields {
+		keys[k] = true
+	}
+	for k := range combined.Fields {
+		keys[k] = true
+	}
+
+	agreed := 0
+	for k := range keys {
+		a, b := perEngine.Fields[k], combined.Fields[k]
+		if sameValue(a, b) {
+			agreed++
+			continue
+		}
+		c.Differences[k] = llmDifference{PerEngine: a, Combined: b}
+	}
+	if len(keys) > 0 {
+		c.Agreement = float64(agreed) / float64(len(keys))
+	}
+	return c
+}
+
+func sameValue(a, b interface{}) bool {
+	if isMissingValue(a) || isMissingValue(b) {
+		return isMissingValue(a) == isMissingValue(b)
+	}
+	return normalizeForMatch(fmt.Sprint(a)) == normalizeForMatch(fmt.Sprint(b))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// minimum similarity between a field value and the ocr words for them to be taken as its source
+	minLocateScore = 0.75
+	// longest run of words considered for a single field value
+	maxLocateWords = 10
+)
+
+// fieldDetail describes where an extracted value was found in the document.
+type fieldDetail struct {
+	Source     string        `json:"source,omitempty"`
+	Page       int           `json:"page,omitempty"`
+	Polygon    []float64     `json:"polygon,omitempty"`
+	Confidence float64       `json:"confidence"`
+	Words      []locatedWord `json:"words,omitempty"`
+	// Handwritten is set when any of the words the value was found in is handwritten
+	Handwritten bool `json:"handwritten"`
+	// Verified tells whether the llm agreed with the value a structured azure model returned
+	Verified *bool `json:"verified,omitempty"`
+	// Native is the rendering of a name in the regional script printed next to it
+	Native *nativeName `json:"native,omitempty"`
+
+	words []ocrWord
+}
+
+type locatedWord struct {
+	Content string    `json:"content"`
+	Polygon []float64 `json:"polygon"`
+}
+
+// isMissingValue reports whether the llm left the field empty, it is told to use nil for those.
+func isMissingValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "nil", "null", "none", "n/a":
+		return true
+	}
+	return false
+}
+
+// locateFields maps every extracted value back to the ocr words that support it. Documents are tried in
+// order, so the one the fields were extracted from should come first.
+func locateFields(fields map[string]interface{}, docs ...*ocrDocument) map[string]*fieldDetail {
+	details := map[string]*fieldDetail{}
+	for name, v := range fields {
+		if isMissingValue(v) {
+			continue
+		}
+		value, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		for _, doc := range docs {
+			if d := locateValue(value, doc); d != nil {
+				details[name] = d
+				break
+			}
+		}
+	}
+	return details
+}
+
+// wordRun is a run of consecutive words, Start and End inclusive, matching a value.
+type wordRun struct {
+	Start int
+	End   int
+	Score float64
+}
+
+// matchRuns returns every non overlapping run of words matching the value, best match first.
+func matchRuns(value string, doc *ocrDocument) []wordRun {
+	target := normalizeForMatch(value)
+	if target == "" || doc == nil {
+		return nil
+	}
+
+	normalized := make([]string, len(doc.Words))
+	for i, w := range doc.Words {
+		normalized[i] = normalizeForMatch(w.Content)
+	}
+
+	var candidates []wordRun
+	for i := range doc.Words {
+		best := wordRun{Start: i, End: -1}
+		concat := ""
+		for j := i; j < len(doc.Words) && j-i < maxLocateWords; j++ {
+			if normalized[j] == "" {
+				continue
+			}
+			concat += normalized[j]
+			if len([]rune(concat)) > 2*len([]rune(target))+4 {
+				break
+			}
+
+			score := similarity(target, concat)
+			if strings.Contains(concat, target) {
+				// the word carries a label or punctuation around the value, e.g. "DOB:05/12/1989"
+				score = math.Max(score, 0.85+0.15*float64(len([]rune(target)))/float64(len([]rune(concat))))
+			}
+			if score > best.Score {
+				best.End, best.Score = j, score
+			}
+		}
+		if best.Score >= minLocateScore {
+			candidates = append(candidates, best)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	var runs []wordRun
+	for _, c := range candidates {
+		overlaps := false
+		for _, r := range runs {
+			if c.Start <= r.End && r.Start <= c.End {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			runs = append(runs, c)
+		}
+	}
+	return runs
+}
+
+// locateValue finds the run of consecutive words that best matches the value.
+func locateValue(value string, doc *ocrDocument) *fieldDetail {
+	runs := matchRuns(value, doc)
+	if len(runs) == 0 {
+		return nil
+	}
+
+	words := doc.Words[runs[0].Start : runs[0].End+1]
+	d := &fieldDetail{
+		Source: doc.Engine,
+		Page:   words[0].Page,
+		words:  words,
+	}
+
+	var polygons [][]float64
+	confidence := 0.0
+	for _, w := range words {
+		d.Words = append(d.Words, locatedWord{Content: w.Content, Polygon: w.Polygon})
+		polygons = append(polygons, w.Polygon)
+		confidence += w.Confidence
+	}
+	d.Polygon = boundingPolygon(polygons...)
+	d.Confidence = math.Round(confidence/float64(len(words))*1000) / 1000
+
+	return d
+}
+
+// boundingPolygon returns the axis aligned box around the polygons as a clockwise 4 point polygon.
+func boundingPolygon(polygons ...[]float64) []float64 {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range polygons {
+		for i := 0; i+1 < len(p); i += 2 {
+			minX, maxX = math.Min(minX, p[i]), math.Max(maxX, p[i])
+			minY, maxY = math.Min(minY, p[i+1]), math.Max(maxY, p[i+1])
+		}
+	}
+	if math.IsInf(minX, 1) {
+		return nil
+	}
+	return []float64{minX, minY, maxX, minY, maxX, maxY, minX, maxY}
+}
+
+// normalizeForMatch lowercases the text and keeps only letters, digits and combining marks so that
+// spacing and punctuation differences between the llm output and ocr do not matter.
+func normalizeForMatch(s string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// similarity is 1 minus the edit distance relative to the longer string.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -1,20 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strings"
-	"time"
 
 	"github.com/Bureau-Inc/overwatch-common/logger"
 	"github.com/Bureau-Inc/overwatch-common/logger/tag"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/rekognition"
 )
 
@@ -31,6 +33,125 @@ type payload struct {
 	BackURL      string `json:"backUrl"`
 	GPTPrompt    string `json:"prompt"`
 	OutputFields string `json:"outputFields"`
+
+	// image pre-processing applied before ocr
+	Grayscale       bool `json:"grayscale"`
+	EnhanceContrast bool `json:"enhanceContrast"`
+
+	// SkipQualityCheck sends the image to ocr even when it looks blurry or badly lit
+	SkipQualityCheck bool `json:"skipQualityCheck"`
+
+	// Redact returns a copy of the image with the configured fields masked
+	Redact *redactOptions `json:"redact"`
+
+	// Handwriting is "flag" to only mark handwritten fields or "exclude" to keep handwritten text away from the llm
+	Handwriting string `json:"handwriting"`
+
+	// AzureModel overrides the azure model of the doc type, e.g. prebuilt-idDocument or a custom model id
+	AzureModel string `json:"azureModel"`
+	// VerifyWithLLM still runs the llm when the azure model returns fields, to verify them
+	VerifyWithLLM bool `json:"verifyWithLlm"`
+
+	// AWSEngine is the aws ocr engine compared against azure, rekognition or textract
+	AWSEngine string `json:"awsEngine"`
+	// OCREngines replaces the default azure and aws engines, e.g. ["tesseract"] to run offline
+	OCREngines []string `json:"ocrEngines"`
+	// FallbackEngine replaces an engine that fails, e.g. tesseract when a cloud provider is down
+	FallbackEngine string `json:"fallbackEngine"`
+	// Ensemble votes the ocr engines into one consensus text instead of asking the llm once per engine
+	Ensemble *bool `json:"ensemble"`
+	// LLMMode is per-engine, combined to reconcile all engines in one llm call, or compare to report on both
+	LLMMode string `json:"llmMode"`
+	// Extractor is llm, hybrid to fill the fields found by pattern rules first, or rules to never call the llm
+	Extractor string `json:"extractor"`
+	// NoCache runs the ocr and the extraction again even when the document was seen before
+	NoCache bool `json:"noCache"`
+	// CallbackURL of a job is sent the job and its result once it completes, signed with WEBHOOK_SECRET
+	CallbackURL string `json:"callbackUrl"`
+}
+
+type analysisOptions struct {
+	Preprocess       preprocessOptions
+	SkipQualityCheck bool
+	Redact           *redactOptions
+	Handwriting      string
+	AzureModel       string
+	VerifyWithLLM    bool
+	AWSEngine        string
+	OCREngines       []string
+	FallbackEngine   string
+	Ensemble         bool
+	LLMMode          string
+	Extractor        string
+	NoCache          bool
+}
+
+// docAnalysis holds the extracted fields along with details of how they were produced.
+type docAnalysis struct {
+	Fields map[string]interface{}
+	Meta   analysisMeta
+}
+
+type analysisMeta struct {
+	AzureModel string `json:"azureModel,omitempty"`
+	// Engines are the ocr engines that ran and Engine the one the fields were extracted from
+	Engines       []string          `json:"engines"`
+	Engine        string            `json:"engine"`
+	Preprocessing *preprocessReport `json:"preprocessing,omitempty"`
+	Quality       *qualityReport    `json:"quality,omitempty"`
+	// Fields has the location of each extracted value, polygons are in pixels of the submitted image
+	Fields    map[string]*fieldDetail `json:"fields,omitempty"`
+	Redaction *redactionResult        `json:"redaction,omitempty"`
+	// HandwritingRatio is the share of the document content that is handwritten
+	HandwritingRatio float64           `json:"handwritingRatio"`
+	Languages        []languageSummary `json:"languages,omitempty"`
+	// Alternates are the words the ocr engines disagreed on when they were ensembled
+	Alternates []ensembleAlternate `json:"alternates,omitempty"`
+	LLMMode    string              `json:"llmMode,omitempty"`
+	// FieldSources is the engine the llm trusted for each field in the combined mode
+	FieldSources  map[string]string `json:"fieldSources,omitempty"`
+	LLMComparison *llmComparison    `json:"llmComparison,omitempty"`
+	Extractor     string            `json:"extractor,omitempty"`
+	// RuleFields are the fields taken from the pattern rules rather than the llm
+	RuleFields []string `json:"ruleFields,omitempty"`
+	// Usage is the ocr pages and llm tokens the request used and their cost
+	Usage *usageReport `json:"usage,omitempty"`
+	// Cached is set when the whole analysis was served from the cache
+	Cached bool `json:"cached,omitempty"`
+}
+
+// response returns the extracted fields with the analysis details under the "_meta" key.
+func (d *docAnalysis) response() map[string]interface{} {
+	r := make(map[string]interface{}, len(d.Fields)+1)
+	for k, v := range d.Fields {
+		r[k] = v
+	}
+	r["_meta"] = d.Meta
+	return r
+}
+
+func (p *payload) analysisOptions() analysisOptions {
+	opts := analysisOptions{
+		Preprocess:       defaultPreprocessOptions(),
+		SkipQualityCheck: p.SkipQualityCheck,
+		Redact:           p.Redact,
+		Handwriting:      strings.ToLower(p.Handwriting),
+		AzureModel:       p.AzureModel,
+		VerifyWithLLM:    p.VerifyWithLLM,
+		AWSEngine:        p.AWSEngine,
+		OCREngines:       p.OCREngines,
+		FallbackEngine:   p.FallbackEngine,
+		LLMMode:          p.LLMMode,
+		Extractor:        p.Extractor,
+		NoCache:          p.NoCache,
+		Ensemble:         os.Getenv("OCR_ENSEMBLE") == "true",
+	}
+	if p.Ensemble != nil {
+		opts.Ensemble = *p.Ensemble
+	}
+	opts.Preprocess.Grayscale = p.Grayscale
+	opts.Preprocess.EnhanceContrast = p.EnhanceContrast
+	return opts
 }
 
 func buildErrorResp(err error) events.APIGatewayProxyResponse {
@@ -50,6 +171,59 @@ func buildErrorResp(err error) events.APIGatewayProxyResponse {
 	}
 }
 
+// buildRetakeResp asks the client for a better photo, listing what was wrong with the submitted one.
+func buildRetakeResp(err *qualityError) events.APIGatewayProxyResponse {
+	e := map[string]interface{}{
+		"error":   err.Error(),
+		"retake":  true,
+		"reasons": err.Issues,
+		"quality": err.Report,
+	}
+
+	b, _ := json.Marshal(e)
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 422,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body:            string(b),
+		IsBase64Encoded: false,
+	}
+}
+
+// inputError is a failure caused by the request itself, e.g. an unsupported option or an image that is not
+// one. Sending the request again fails the same way, so it is a bad request and never retried.
+type inputError struct {
+	err error
+}
+
+func (e *inputError) Error() string {
+	return e.err.Error()
+}
+
+func invalidInput(err error) error {
+	return &inputError{err: err}
+}
+
+func buildBadRequestResp(err error) events.APIGatewayProxyResponse {
+	return buildJSONResp(http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+}
+
+// buildAnalysisErrorResp builds the response for a failed analysis, quality rejections and invalid input
+// are not server errors.
+func buildAnalysisErrorResp(msg string, err error) events.APIGatewayProxyResponse {
+	var qErr *qualityError
+	if errors.As(err, &qErr) {
+		return buildRetakeResp(qErr)
+	}
+	var iErr *inputError
+	if errors.As(err, &iErr) {
+		return buildBadRequestResp(fmt.Errorf("%s: %v", msg, err))
+	}
+	return buildErrorResp(fmt.Errorf("%s: %v", msg, err))
+}
+
 func buildSuccessResponse(d map[string]interface{}) events.APIGatewayProxyResponse {
 	b, _ := json.Marshal(d)
 	return events.APIGatewayProxyResponse{
@@ -63,14 +237,31 @@ func buildSuccessResponse(d map[string]interface{}) events.APIGatewayProxyRespon
 }
 
 func HandleRequest(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// POST /jobs runs the analysis in the background, GET /jobs/{id} returns its status and result and
+	// POST /batch processes many payloads
+	switch {
+	case req.HTTPMethod == http.MethodPost && isJobsPath(req.Path):
+		return submitJob(req), nil
+	case req.HTTPMethod == http.MethodPost && isBatchPath(req.Path):
+		return submitBatch(req), nil
+	case req.HTTPMethod == http.MethodGet && jobIDOf(req) != "":
+		return getJob(jobIDOf(req), tenantOf(req)), nil
+	}
+
 	input := &payload{}
 	if err := json.Unmarshal([]byte(req.Body), input); err != nil {
-		return buildErrorResp(fmt.Errorf("failed to unmarshal input:%v", err)), nil
+		return buildBadRequestResp(fmt.Errorf("failed to unmarshal input:%v", err)), nil
 	}
 
+	return processPayload(input, tenantOf(req)), nil
+}
+
+// processPayload runs the analysis the payload asks for and builds the api response, the tenant is who
+// the usage is billed to.
+func processPayload(input *payload, tenant string) events.APIGatewayProxyResponse {
 	logger.INFO("got input", tag.NewAnyTag("input", input))
 
-	var result map[string]interface{}
+	var result *docAnalysis
 	var err error
 	var docType string
 	if input.DocType == "" {
@@ -80,204 +271,376 @@ func HandleRequest(req events.APIGatewayProxyRequest) (events.APIGatewayProxyRes
 	}
 	switch docType {
 	case panDoc:
-		result, err = doDocAnalysis(input.FrontURL, panDoc, "")
+		result, err = doDocAnalysis(input.FrontURL, panDoc, "", input.analysisOptions())
 		if err != nil {
 			logger.ERROR("failed to do pan analysis", tag.NewErrorTag(err))
-			return buildErrorResp(fmt.Errorf("failed to do pan analysis: %v", err)), nil
+			return buildAnalysisErrorResp("failed to do pan analysis", err)
 		}
 	case aadharDoc:
-		result, err = doDocAnalysis(input.FrontURL, aadharDoc, "")
+		result, err = doDocAnalysis(input.FrontURL, aadharDoc, "", input.analysisOptions())
 		if err != nil {
 			logger.ERROR("failed to do aadhar analysis", tag.NewErrorTag(err))
-			return buildErrorResp(fmt.Errorf("failed to do aadhar analysis: %v", err)), nil
+			return buildAnalysisErrorResp("failed to do aadhar analysis", err)
 		}
 	case unknownDoc:
 		// if outputJSON is absent, return error
 		if input.OutputFields == "" {
-			return buildErrorResp(fmt.Errorf("for empty docType provide a desired output JSON in OutputJSON")), nil
+			return buildBadRequestResp(fmt.Errorf("for empty docType provide a desired output JSON in OutputJSON"))
 		} else {
-			result, err = doDocAnalysis(input.FrontURL, unknownDoc, input.OutputFields)
+			result, err = doDocAnalysis(input.FrontURL, unknownDoc, input.OutputFields, input.analysisOptions())
 			if err != nil {
 				logger.ERROR("failed to do unknown doc analysis", tag.NewErrorTag(err))
-				return buildErrorResp(fmt.Errorf("failed to do unknown doc analysis: %v", err)), nil
+				return buildAnalysisErrorResp("failed to do unknown doc analysis", err)
 			}
 		}
-
+	default:
+		return buildBadRequestResp(fmt.Errorf("unsupported docType: %s", input.DocType))
 	}
 
-	logger.INFO("got output", tag.NewAnyTag("output", result))
-	return buildSuccessResponse(result), nil
+	logger.INFO("got output", tag.NewAnyTag("output", result.Fields))
+	emitUsageMetrics(tenant, docType, result.Meta.Usage)
+	return buildSuccessResponse(result.response())
 }
 
-// 		"body": "{\"docType\":\"pan\",\"frontUrl\":\"https://i.ibb.co/jHpMgnw/a597c560-ce50-47e5-bf73-ebe7418d1200.jpg\"}",
-// 		"body": "{\"frontUrl\":\"https://i.ibb.co/jHpMgnw/a597c560-ce50-47e5-bf73-ebe7418d1200.jpg\"\"outputFields\": \"{[\"name\"]}",
-
 func main() {
-	// read from event.json file
-	event := []byte(`{
-		"type": "REQUEST",
-		"methodArn": "arn:aws:execute-api:us-east-1:123456789012:abcdef123/test/GET/request",
-		"resource": "/request",
-		"body": "{\"docType\":\"\",\"frontUrl\":\"https://officeanywhere.io/images/payslip.jpg\", \"outputFields\": \"name\"}",
-		"path": "/request",
-		"httpMethod": "POST",
-		"headers": {
-		  "X-AMZ-Date": "20170718T062915Z",
-		  "Accept": "*/*",
-		  "HeaderAuth1": "headerValue1",
-		  "CloudFront-Viewer-Country": "US",
-		  "CloudFront-Forwarded-Proto": "https",
-		  "CloudFront-Is-Tablet-Viewer": "false",
-		  "CloudFront-Is-Mobile-Viewer": "false",
-		  "User-Agent": "..."
-		},
-		"queryStringParameters": {
-		  "QueryString1": "queryValue1"
-		},
-		"pathParameters": {},
-		"stageVariables": {
-		  "StageVar1": "stageValue1"
-		},
-		"requestContext": {
-		  "path": "/request",
-		  "accountId": "123456789012",
-		  "resourceId": "05c7jb",
-		  "stage": "test",
-		  "requestId": "...",
-		  "identity": {
-			"apiKey": "...",
-			"sourceIp": "...",
-			"clientCert": {
-			  "clientCertPem": "CERT_CONTENT",
-			  "subjectDN": "www.example.com",
-			  "issuerDN": "Example issuer",
-			  "serialNumber": "a1:a1:a1:a1:a1:a1:a1:a1:a1:a1:a1:a1:a1:a1:a1:a1",
-			  "validity": {
-				"notBefore": "May 28 12:30:02 2019 GMT",
-				"notAfter": "Aug  5 09:36:04 2021 GMT"
-			  }
-			}
-		  },
-		  "resourcePath": "/request",
-		  "httpMethod": "GET",
-		  "apiId": "abcdef123"
+	// run as a command when given one, e.g. nergpt serve, otherwise as a lambda
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			os.Exit(runServe(os.Args[2:]))
+		case "extract":
+			os.Exit(runExtract(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "eval":
+			os.Exit(runEval(os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n", os.Args[1])
+			os.Exit(2)
 		}
-	}`)
-
-	// unmarshal events.APIGatewayProxyRequest
-	var req events.APIGatewayProxyRequest
-	if err := json.Unmarshal(event, &req); err != nil {
-		fmt.Println(err)
 	}
 
-	lambda.Start(HandleRequest)
-	// HandleRequest(req)
+	// HANDLER picks the event source the lambda is deployed for
+	switch os.Getenv("HANDLER") {
+	case handlerJobs:
+		lambda.Start(HandleJobQueue)
+	case handlerS3:
+		allowAnyS3Bucket = true
+		lambda.Start(HandleS3Event)
+	default:
+		lambda.Start(HandleRequest)
+	}
 }
 
-func doDocAnalysis(imageURL string, docType string, desiredFields string) (map[string]interface{}, error) {
-	// azure ocr analysis
-	analysisReqID, err := submitOCRAnalysis(imageURL)
+func doDocAnalysis(imageURL string, docType string, desiredFields string, opts analysisOptions) (out *docAnalysis, err error) {
+	engines, err := ocrEnginesFor(opts.OCREngines, opts.AWSEngine)
+	if err != nil {
+		return nil, invalidInput(err)
+	}
+	mode, err := llmModeFor(opts.LLMMode)
+	if err != nil {
+		return nil, invalidInput(err)
+	}
+	extractor, err := extractorFor(opts.Extractor, docType)
 	if err != nil {
-		return nil, fmt.Errorf("failed to submit ocr analysis: %v", err)
+		return nil, invalidInput(err)
+	}
+	prices, err := loadPriceTable()
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := fallbackEngineFor(opts.FallbackEngine)
+	if err != nil {
+		return nil, invalidInput(err)
+	}
+	model, err := azureModelFor(docType, opts.AzureModel)
+	if err != nil {
+		return nil, invalidInput(err)
 	}
 
-	time.Sleep(2 * time.Second)
+	raw, err := fetchImage(imageURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
+
+	// a resubmitted document gets the extraction made the first time, noCache skips the lookup
+	store := cacheFor()
+	resultKey := resultCacheKey(raw, docType, desiredFields, opts, append([]string{fallback, mode, extractor, model}, engines...)...)
+	cached := &docAnalysis{}
+	if !opts.NoCache && cacheGet(store, resultKey, cached) {
+		logger.INFO("using cached analysis", tag.NewStringTag("key", resultKey))
+		cached.Meta.Cached = true
+		cached.Meta.Usage = buildUsageReport(nil, nil, prices)
+		return cached, nil
+	}
+	defer func() {
+		if err == nil && out != nil {
+			cachePut(store, resultKey, out, cacheTTL("RESULT_CACHE_TTL", defaultResultCacheTTL))
+		}
+	}()
 
-	result, err := fetchOCRAnalysisResult(analysisReqID)
+	img, err := preprocessImage(raw, opts.Preprocess)
+	var decodeErr *decodeError
+	if errors.As(err, &decodeErr) {
+		// pdf, tiff, heic and the like are read by the providers themselves
+		logger.INFO("sending undecoded document as it is", tag.NewErrorTag(err))
+		img, err = undecodedImage(raw), nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch ocr analysis result: %v", err)
+		return nil, invalidInput(fmt.Errorf("failed to preprocess image: %v", err))
 	}
-	azureOCRContent := result.AnalyzeResult.Content
+	logger.INFO("preprocessed image", tag.NewAnyTag("report", img.Report))
 
-	// aws ocr analysis
-	resultfromaws, err := fetchOCRAnalysisResultfromAWS(imageURL)
+	// reject unusable photos before any paid api is called
+	var quality *qualityReport
+	if img.decoded() {
+		quality = assessQuality(img.Source)
+		logger.INFO("assessed image quality", tag.NewAnyTag("report", quality))
+		if err := checkQuality(quality); err != nil && !opts.SkipQualityCheck {
+			return nil, err
+		}
+	}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch ocr analysis result from aws: %v", err)
+	runner := newOCRRunner(engines, docType, model, fallback, store, opts.NoCache)
+
+	// azure ocr analysis goes first, its skew angle and structured fields are used for the other engines
+	var runs []*engineRun
+	var rest []string
+	for _, e := range engines {
+		if e != engineAzure {
+			rest = append(rest, e)
+			continue
+		}
+		run, err := runner.run(e, img)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	var result *AnalyzeResult
+	var azureDoc *ocrDocument
+	if azure := azureRun(runs); azure != nil {
+		result, azureDoc = azure.Azure, azure.Doc
+	}
+
+	analysis := &docAnalysis{Meta: analysisMeta{
+		Preprocessing:    img.Report,
+		Quality:          quality,
+		HandwritingRatio: handwritingRatio(result),
+		Languages:        summarizeLanguages(result),
+	}}
+
+	// a structured model already gives the fields, the llm is then only used to verify them if asked
+	var structured map[string]interface{}
+	if result != nil {
+		analysis.Meta.AzureModel = model
+		structured = structuredFields(result, model, docType)
+	}
+	if structured != nil && !opts.VerifyWithLLM {
+		logger.INFO("using fields of structured azure model", tag.NewStringTag("model", model))
+		analysis.Fields = structured
+		analysis.Meta.Engines = []string{engineAzure}
+		analysis.Meta.Engine = engineAzure
+		analysis.Meta.Usage = buildUsageReport(runs, nil, prices)
+		if err := enrichAnalysis(analysis, img, result, azureDoc, []*ocrDocument{azureDoc}, docType, opts); err != nil {
+			return nil, err
+		}
+		return analysis, nil
+	}
+
+	// the other engines have no skew correction of their own, rotate using the angle azure detected
+	if result != nil && len(result.Pages) > 0 {
+		img, err = img.deskew(result.Pages[0].Angle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deskew image: %v", err)
+		}
 	}
 
-	awsOCRContent := fetchFullTextFromOCRTextAWS(resultfromaws)
+	for _, e := range rest {
+		run, err := runner.run(e, img)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
 
-	logger.INFO("got result from aws", tag.NewAnyTag("result", awsOCRContent))
-	logger.INFO("got result from azure", tag.NewAnyTag("result", azureOCRContent))
+	azurePromptDoc := azureDoc
+	if azureDoc != nil && opts.Handwriting == handwritingExclude {
+		azurePromptDoc = withoutHandwriting(azureDoc, azureDoc)
+	}
 
-	azureResultScore := fetchCombinedNormalizedConfidenceScoreForAzure(&result.AnalyzeResult)
-	logger.INFO("got result from azure", tag.NewAnyTag("result", azureResultScore))
+	// every engine is serialized line by line in reading order so the llm gets comparable input
+	promptDocs := make([]*ocrDocument, 0, len(runs))
+	for _, run := range runs {
+		promptDoc := run.Doc
+		if opts.Handwriting == handwritingExclude {
+			promptDoc = withoutHandwriting(promptDoc, azureDoc)
+		}
+		// rekognition and textract only read latin script, use what azure read for hindi and other regional text
+		if azurePromptDoc != nil && run.Engine != engineAzure {
+			promptDoc = mergeNativeText(promptDoc, azurePromptDoc)
+		}
+		promptDocs = append(promptDocs, promptDoc)
 
-	awsResultScore := fetchCombinedNormalizedConfidenceScoreForAWS(resultfromaws)
-	logger.INFO("got result from aws", tag.NewAnyTag("result", awsResultScore))
+		logger.INFO("got result from "+run.Engine, tag.NewAnyTag("result", promptDoc.Text))
+		logger.INFO("got result from "+run.Engine, tag.NewAnyTag("result", run.Score))
+	}
 
-	gptResultRawAzure, err := askGPTForPIIAnalysis(azureOCRContent, docType, desiredFields)
-	if err != nil {
-		return nil, fmt.Errorf("failed to ask gpt for PII analysis: %v", err)
+	// the ensemble votes the engines into one consensus text, which takes a single llm call
+	sources, sourceDocs, texts := runs, promptDocs, make([]string, 0, len(runs))
+	for _, d := range promptDocs {
+		texts = append(texts, d.Text)
+	}
+	if opts.Ensemble && len(runs) > 1 {
+		consensus, alternates := ensembleDocuments(runs, promptDocs)
+		logger.INFO("got ensemble result", tag.NewAnyTag("result", consensus.Text), tag.NewAnyTag("alternates", len(alternates)))
+		analysis.Meta.Alternates = alternates
+		sources = []*engineRun{{
+			Engine: engineEnsemble,
+			Doc:    consensus,
+			Score:  fetchCombinedNormalizedConfidenceScore(consensus),
+		}}
+		sourceDocs = []*ocrDocument{consensus}
+		texts = []string{withAlternates(consensus.Text, alternates)}
+	}
+	for i, run := range sources {
+		dump("ocr", run.Engine, texts[i])
 	}
 
-	gptResultRawAWS, err := askGPTForPIIAnalysis(awsOCRContent, docType, desiredFields)
-	if err != nil {
-		return nil, fmt.Errorf("failed to ask gpt for PII analysis: %v", err)
+	// the rules find most pan and aadhaar fields by their pattern, the llm is only asked when they miss some
+	var rules map[string]ruleValue
+	if extractor != extractorLLM {
+		rules = extractWithRules(sourceDocs, docType)
+		logger.INFO("extracted fields with rules", tag.NewAnyTag("fields", rules))
 	}
+	analysis.Meta.Extractor = extractor
 
-	gptResultAzureMap := map[string]interface{}{}
-	err = json.Unmarshal([]byte(gptResultRawAzure), &gptResultAzureMap)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode gpt result: %v", err)
+	// the hybrid mode only asks the llm for the fields the rules missed or are unsure of
+	llmFields := desiredFields
+	if extractor == extractorHybrid {
+		llmFields = strings.Join(ruleGaps(rules, docType), ",")
 	}
 
-	gptResultAWSMap := map[string]interface{}{}
-	err = json.Unmarshal([]byte(gptResultRawAWS), &gptResultAWSMap)
+	var ex *extraction
+	switch {
+	case extractor == extractorRules || (extractor == extractorHybrid && rulesComplete(rules, docType)):
+		ex = ruleExtraction(rules, docType, len(sources))
+		for k := range rules {
+			analysis.Meta.RuleFields = append(analysis.Meta.RuleFields, k)
+		}
+	case mode == llmModeCombined && len(sources) > 1:
+		ex, err = extractCombined(sources, texts, docType, llmFields)
+	default:
+		ex, err = extractPerEngine(sources, texts, docType, llmFields)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode gpt result: %v", err)
+		return nil, err
+	}
+	if ex.Calls > 0 {
+		analysis.Meta.LLMMode = mode
+		analysis.Meta.FieldSources = ex.FieldSources
+		if extractor == extractorHybrid {
+			analysis.Meta.RuleFields = overlayRules(ex.Fields, rules)
+			if _, ok := ex.Fields["docType"]; !ok {
+				ex.Fields["docType"] = ruleDocTypes[docType]
+			}
+		}
 	}
+	sort.Strings(analysis.Meta.RuleFields)
 
-	// return the map that has more number of non null values. If both have same number of non null values then return the map with higher confidence score
-	azureNonNullCount := 0
-	awsNonNullCount := 0
-	for _, v := range gptResultAzureMap {
-		logger.INFO("azure result", tag.NewAnyTag("result", v))
-		if v != "nil" {
-			azureNonNullCount++
+	// the combined answer is only reported on, the response keeps the per engine fields
+	var combined *extraction
+	if mode == llmModeCompare && ex.Calls > 0 && len(sources) > 1 {
+		combined, err = extractCombined(sources, texts, docType, llmFields)
+		if err != nil {
+			return nil, err
 		}
+		analysis.Meta.LLMComparison = compareExtractions(ex, combined, prices)
+		logger.INFO("compared llm modes", tag.NewAnyTag("comparison", analysis.Meta.LLMComparison))
 	}
 
-	for _, v := range gptResultAWSMap {
-		if v != "nil" {
-			awsNonNullCount++
+	// docs to locate the values in, the engine the fields were extracted from goes first. An ensemble is
+	// followed by the engines it was voted from
+	best := sources[ex.Order[0]]
+	docs := make([]*ocrDocument, 0, len(runs)+1)
+	for _, i := range ex.Order {
+		docs = append(docs, sources[i].Doc)
+	}
+	for _, run := range runs {
+		analysis.Meta.Engines = append(analysis.Meta.Engines, run.Engine)
+		if best.Engine == engineEnsemble {
+			docs = append(docs, run.Doc)
 		}
 	}
+	analysis.Fields = ex.Fields
+	analysis.Meta.Engine = best.Engine
+	analysis.Meta.Usage = buildUsageReport(runs, []*extraction{ex, combined}, prices)
+	logger.INFO("usage of the request", tag.NewAnyTag("usage", analysis.Meta.Usage))
 
-	logger.INFO("azure non null count", tag.NewAnyTag("count", azureNonNullCount))
-	logger.INFO("aws non null count", tag.NewAnyTag("count", awsNonNullCount))
+	var verified map[string]bool
+	if structured != nil {
+		verified = verifyStructuredFields(structured, analysis.Fields)
+		analysis.Fields = structured
+	}
 
-	if azureNonNullCount > awsNonNullCount {
-		logger.INFO("azure non null count is higher")
-		return gptResultAzureMap, nil
-	} else if azureNonNullCount < awsNonNullCount {
-		logger.INFO("aws non null count is higher")
-		return gptResultAWSMap, nil
-	} else {
-		if azureResultScore > awsResultScore {
-			logger.INFO("azure result score is higher")
-			return gptResultAzureMap, nil
+	if err := enrichAnalysis(analysis, img, result, azureDoc, docs, docType, opts); err != nil {
+		return nil, err
+	}
+	for k, ok := range verified {
+		if d, found := analysis.Meta.Fields[k]; found {
+			v := ok
+			d.Verified = &v
+		}
+	}
+
+	return analysis, nil
+}
+
+// enrichAnalysis adds the location, handwriting and native script details of the extracted fields and
+// the redacted image. docs are the ocr documents to locate the values in, best source first.
+func enrichAnalysis(analysis *docAnalysis, img *preparedImage, result *AnalyzeResult, azureDoc *ocrDocument, docs []*ocrDocument, docType string, opts analysisOptions) error {
+	analysis.Meta.Fields = locateFields(analysis.Fields, docs...)
+	flagHandwrittenFields(analysis.Meta.Fields, azureDoc)
+
+	// return names in the regional script next to the english ones, e.g. fullNameNative. Without azure
+	// the best engine is used, tesseract reads devanagari with the hin language pack
+	nativeDoc := azureDoc
+	if nativeDoc == nil {
+		nativeDoc = docs[0]
+	}
+	for field, name := range findNativeNames(analysis.Fields, nativeDoc, result) {
+		analysis.Fields[field+"Native"] = name.Value
+		if d, ok := analysis.Meta.Fields[field]; ok {
+			d.Native = name
 		}
-		logger.INFO("aws result score is higher")
-		return gptResultAWSMap, nil
 	}
+	crossCheckNames(analysis.Fields, analysis.Meta.Fields)
+
+	if opts.Redact != nil {
+		redaction, err := redactDocument(img, analysis.Fields, docs, docType, opts.Redact)
+		if err != nil {
+			return fmt.Errorf("failed to redact document: %v", err)
+		}
+		analysis.Meta.Redaction = redaction
+	}
+
+	return nil
 }
 
-func submitOCRAnalysis(imageURL string) (requestID string, err error) {
-	ocrServiceHostURL := "https://idv-ocr-poc.cognitiveservices.azure.com/formrecognizer/documentModels/prebuilt-read:analyze?api-version=2022-08-31&stringIndexType=textElements"
+func submitOCRAnalysis(image []byte, model string) (requestID string, err error) {
+	ocrServiceHostURL := fmt.Sprintf("https://idv-ocr-poc.cognitiveservices.azure.com/formrecognizer/documentModels/%s:analyze?api-version=2022-08-31&stringIndexType=textElements", url.PathEscape(model))
 
-	payload := strings.NewReader(fmt.Sprintf(`{"urlSource": "%s"}`, imageURL))
-	req, err := http.NewRequest("POST", ocrServiceHostURL, payload)
+	req, err := http.NewRequest("POST", ocrServiceHostURL, bytes.NewReader(image))
 	if err != nil {
 		return "", fmt.Errorf("failed to construct request: %v", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", "application/octet-stream")
 	// TODO: get the key from env
 	req.Header.Set("Ocp-Apim-Subscription-Key", "cebb95ebad534bdba340eed6556691d2")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to make request: %v", err)
 	}
@@ -299,31 +662,69 @@ func submitOCRAnalysis(imageURL string) (requestID string, err error) {
 	return resp.Header.Get("apim-request-id"), nil
 }
 
-func fetchOCRAnalysisResultfromAWS(imageURL string) (*rekognition.DetectTextOutput, error) {
-	// upload image to s3
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String("ap-south-1"),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create session: %v", err)
+// fetchImage downloads the image from an http url, or from s3 for an s3://bucket/key uri of an allowed
+// bucket. file:// urls are only read for the cli.
+func fetchImage(imageURL string) ([]byte, error) {
+	if stubs != nil {
+		return stubs.image(imageURL)
+	}
+	if strings.HasPrefix(imageURL, "s3://") {
+		bucket, key, err := parseS3URI(imageURL)
+		if err != nil {
+			return nil, invalidInput(err)
+		}
+		if !s3BucketAllowed(bucket) {
+			return nil, invalidInput(fmt.Errorf("images are not read from the s3 bucket %s", bucket))
+		}
+		body, err := downloadFromS3(bucket, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get image from s3: %v", err)
+		}
+		return body, nil
+	}
+	if allowLocalFiles && strings.HasPrefix(imageURL, "file://") {
+		body, err := os.ReadFile(strings.TrimPrefix(imageURL, "file://"))
+		if err != nil {
+			return nil, invalidInput(fmt.Errorf("failed to read image file: %v", err))
+		}
+		return body, nil
 	}
 
-	// image URL to Bytes array
-	resp, err := http.Get(imageURL)
+	if u, err := url.Parse(imageURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, invalidInput(fmt.Errorf("invalid image url: %s", imageURL))
+	}
+	resp, err := httpClient.Get(imageURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get image from URL: %v", err)
 	}
 	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("received unexpected status code in response: %d", resp.StatusCode)
+		// the host has no such image, unlike a failing host asking again does not help
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+			return nil, invalidInput(err)
+		}
+		return nil, err
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read image from response: %v", err)
 	}
+	return body, nil
+}
+
+func fetchOCRAnalysisResultfromAWS(image []byte) (*rekognition.DetectTextOutput, error) {
+	svc2, err := newRekognitionClient()
+	if err != nil {
+		return nil, err
+	}
 
 	// call AWS rekognition
-	svc2 := rekognition.New(sess)
 	imageResp, err := svc2.DetectText(&rekognition.DetectTextInput{
 		Image: &rekognition.Image{
-			Bytes: body,
+			Bytes: image,
 		},
 	})
 	if err != nil {
@@ -332,21 +733,8 @@ func fetchOCRAnalysisResultfromAWS(imageURL string) (*rekognition.DetectTextOutp
 	return imageResp, nil
 }
 
-func fetchFullTextFromOCRTextAWS(imageResp *rekognition.DetectTextOutput) string {
-	// append all the response text into a single string
-	var sb strings.Builder
-	for _, text := range imageResp.TextDetections {
-		// check for LINE type
-		if *text.Type == "WORD" {
-			sb.WriteString(*text.DetectedText)
-			sb.WriteString(" ")
-		}
-	}
-	return sb.String()
-}
-
-func fetchOCRAnalysisResult(requestID string) (*OCRAnalysisResult, error) {
-	hostURL := fmt.Sprintf("https://idv-ocr-poc.cognitiveservices.azure.com/formrecognizer/documentModels/prebuilt-read/analyzeResults/%s?api-version=2022-08-31", requestID)
+func fetchOCRAnalysisResult(requestID string, model string) (*OCRAnalysisResult, error) {
+	hostURL := fmt.Sprintf("https://idv-ocr-poc.cognitiveservices.azure.com/formrecognizer/documentModels/%s/analyzeResults/%s?api-version=2022-08-31", url.PathEscape(model), url.PathEscape(requestID))
 
 	req, err := http.NewRequest("GET", hostURL, nil)
 	if err != nil {
@@ -356,7 +744,7 @@ func fetchOCRAnalysisResult(requestID string) (*OCRAnalysisResult, error) {
 	// TODO: get the key from env
 	req.Header.Set("Ocp-Apim-Subscription-Key", "cebb95ebad534bdba340eed6556691d2")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %v", err)
 	}
@@ -393,44 +781,55 @@ func fetchCombinedNormalizedConfidenceScoreForAzure(result *AnalyzeResult) float
 			countWords++
 		}
 	}
+	if countWords == 0 {
+		return 0
+	}
 	// normalize the confidence score 0-10 and round it to int value
 	confidenceScore = confidenceScore / float64(countWords) * 10
 	confidenceScore = math.Round(confidenceScore)
 	return confidenceScore
 }
 
-func fetchCombinedNormalizedConfidenceScoreForAWS(input *rekognition.DetectTextOutput) float64 {
+// fetchCombinedNormalizedConfidenceScore scores the words of a document of any engine, 0 when it has none.
+func fetchCombinedNormalizedConfidenceScore(doc *ocrDocument) float64 {
+	if len(doc.Words) == 0 {
+		return 0
+	}
 	confidenceScore := 0.0
-	countWords := 0
-	for _, text := range input.TextDetections {
-		// check for LINE type
-		if *text.Type == "WORD" {
-			confidenceScore += *text.Confidence / 10
-			countWords++
-		}
+	for _, w := range doc.Words {
+		confidenceScore += w.Confidence
 	}
-	// normalize the confidence score 0-10 from 0-100 and round it to int value
-	confidenceScore = confidenceScore / float64(countWords)
+	// normalize the confidence score 0-10 from 0-1 and round it to int value
+	confidenceScore = confidenceScore / float64(len(doc.Words)) * 10
 	confidenceScore = math.Round(confidenceScore)
 	return confidenceScore
 }
 
-func askGPTForPIIAnalysis(ocrExtractedText string, docType string, desiredJSON string) (string, error) {
+func askGPTForPIIAnalysis(ocrExtractedText string, docType string, desiredJSON string) (string, Usage, error) {
 	escaped := strings.ReplaceAll(ocrExtractedText, "\n", "\\n")
 
+	// the known doc types answer every field of their prompt unless the fields are narrowed down
+	var narrowed string
+	if desiredJSON != "" {
+		narrowed = desiredJsonPrefixPrompt + desiredJSON
+	}
+
 	var prompt string
 	switch docType {
 	case aadharDoc:
-		prompt = systemPrompt + aadharPrompt + escaped + endPrompt
+		prompt = systemPrompt + aadharPrompt + escaped + narrowed + endPrompt
 	case panDoc:
-		prompt = systemPrompt + panPrompt + escaped + endPrompt
-		print("pan prompt: ", prompt)
+		prompt = systemPrompt + panPrompt + escaped + narrowed + endPrompt
 	case unknownDoc:
 
 		// escapedDesiredJson := strings.ReplaceAll(string(desiredJSON), "\n", "\\n")
 		prompt = systemPrompt + noneTypeDocPrompt + escaped + desiredJsonPrefixPrompt + desiredJSON + endPrompt
 	}
 	logger.INFO(prompt)
+	dump("prompt", docType, prompt)
+	if stubs != nil {
+		return stubs.llm()
+	}
 
 	hostURL := "https://bureauteam1.openai.azure.com/openai/deployments/gpt-turbo/chat/completions?api-version=2023-05-15"
 
@@ -438,16 +837,17 @@ func askGPTForPIIAnalysis(ocrExtractedText string, docType string, desiredJSON s
 
 	req, err := http.NewRequest("POST", hostURL, strings.NewReader(prompt))
 	if err != nil {
-		return "", fmt.Errorf("failed to construct request: %v", err)
+		return "", Usage{}, fmt.Errorf("failed to construct request: %v", err)
 	}
 
 	// TODO: get the key from env
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("api-key", "2f70fa159ee04c81b94624e3cbdb41b4")
 
-	resp, err := http.DefaultClient.Do(req)
+	waitForProvider(providerOpenAI)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to make request: %v", err)
+		return "", Usage{}, fmt.Errorf("failed to make request: %v", err)
 	}
 	defer resp.Body.Close()
 
@@ -455,24 +855,29 @@ func askGPTForPIIAnalysis(ocrExtractedText string, docType string, desiredJSON s
 
 	respBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %v", err)
+		return "", Usage{}, fmt.Errorf("failed to read response: %v", err)
 	}
 
 	logger.INFO("received response for askGPTForPIIAnalysis", tag.NewStringTag("response", string(respBytes)))
+	dump("response", docType, string(respBytes))
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("received unexpected status code in response: %d", resp.StatusCode)
+		return "", Usage{}, fmt.Errorf("received unexpected status code in response: %d", resp.StatusCode)
 	}
 
 	d := &GPTResult{}
 	err = json.Unmarshal(respBytes, d)
 	if err != nil {
-		return "", fmt.Errorf("failed to decode response body: %v", err)
+		return "", Usage{}, fmt.Errorf("failed to decode response body: %v", err)
 	}
 
-	return d.Choices[0].Message.Content, nil
+	return d.Choices[0].Message.Content, d.Usage, nil
 }
 
+// promptVersion is part of the cache keys of extractions, bump it whenever the prompts below change so that
+// answers to the old prompts are not served anymore.
+const promptVersion = "1"
+
 var systemPrompt = `{
 "messages": [
 {
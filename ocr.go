@@ -0,0 +1,225 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+)
+
+const (
+	engineAzure       = "azure"
+	engineRekognition = "rekognition"
+
+	// lines whose vertical centers are closer than this share of their height are read as one row
+	sameRowTolerance = 0.5
+)
+
+// ocrWord is a recognised word with its polygon in pixels of the upright source image.
+type ocrWord struct {
+	Content    string
+	Confidence float64 // 0-1
+	Page       int
+	Polygon    []float64
+	// Offset and Length locate the word in the engine's own output, azure counts them in text elements
+	// of its content so they are only comparable with other spans of the same engine
+	Offset int
+	Length int
+	// Handwritten is only detected by azure
+	Handwritten bool
+}
+
+type ocrLine struct {
+	Page    int
+	Polygon []float64
+	Words   []ocrWord
+}
+
+// ocrDocument is the engine independent view of an ocr result. Lines and Words are in reading order and
+// Text is the lines serialized one row per line, so every engine gives the llm the same layout.
+type ocrDocument struct {
+	Engine string
+	Text   string
+	Lines  []ocrLine
+	Words  []ocrWord
+}
+
+// newOCRDocument orders the lines by their position on the page and serializes them.
+func newOCRDocument(engine string, lines []ocrLine) *ocrDocument {
+	doc := &ocrDocument{Engine: engine}
+
+	rows := readingOrder(lines)
+	texts := make([]string, 0, len(rows))
+	for _, row := range rows {
+		var parts []string
+		for _, l := range row {
+			doc.Lines = append(doc.Lines, l)
+			doc.Words = append(doc.Words, l.Words...)
+			if c := l.content(); c != "" {
+				parts = append(parts, c)
+			}
+		}
+		if len(parts) > 0 {
+			texts = append(texts, strings.Join(parts, " "))
+		}
+	}
+	doc.Text = strings.Join(texts, "\n")
+
+	return doc
+}
+
+func (l ocrLine) content() string {
+	parts := make([]string, 0, len(l.Words))
+	for _, w := range l.Words {
+		parts = append(parts, w.Content)
+	}
+	return strings.Join(parts, " ")
+}
+
+// readingOrder groups the lines into rows, top to bottom and left to right within a row. Cards often
+// print a label and its value as separate lines side by side, they belong on the same row.
+func readingOrder(lines []ocrLine) [][]ocrLine {
+	type placed struct {
+		line           ocrLine
+		left, top      float64
+		center, height float64
+	}
+
+	items := make([]placed, 0, len(lines))
+	for _, l := range lines {
+		box := boundingPolygon(l.Polygon)
+		if box == nil {
+			var polygons [][]float64
+			for _, w := range l.Words {
+				polygons = append(polygons, w.Polygon)
+			}
+			box = boundingPolygon(polygons...)
+		}
+		if box == nil {
+			box = make([]float64, 8)
+		}
+		items = append(items, placed{
+			line:   l,
+			left:   box[0],
+			top:    box[1],
+			center: (box[1] + box[5]) / 2,
+			height: box[5] - box[1],
+		})
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].line.Page != items[j].line.Page {
+			return items[i].line.Page < items[j].line.Page
+		}
+		return items[i].top < items[j].top
+	})
+
+	var rows [][]placed
+	for _, it := range items {
+		if n := len(rows); n > 0 {
+			last := rows[n-1][0]
+			tolerance := sameRowTolerance * math.Min(it.height, last.height)
+			if last.line.Page == it.line.Page && math.Abs(it.center-last.center) <= tolerance {
+				rows[n-1] = append(rows[n-1], it)
+				continue
+			}
+		}
+		rows = append(rows, []placed{it})
+	}
+
+	ordered := make([][]ocrLine, 0, len(rows))
+	for _, row := range rows {
+		sort.SliceStable(row, func(i, j int) bool {
+			return row[i].left < row[j].left
+		})
+		lines := make([]ocrLine, 0, len(row))
+		for _, it := range row {
+			lines = append(lines, it.line)
+		}
+		ordered = append(ordered, lines)
+	}
+	return ordered
+}
+
+func normalizeAzureResult(result *AnalyzeResult, img *preparedImage) *ocrDocument {
+	handwritten := handwrittenSpans(result)
+
+	var lines []ocrLine
+	for _, p := range result.Pages {
+		for _, l := range p.Lines {
+			line := ocrLine{Page: p.PageNumber, Polygon: img.sourcePolygon(l.Polygon)}
+			for _, w := range p.Words {
+				inLine := false
+				for _, s := range l.Spans {
+					if w.Span.Offset >= s.Offset && w.Span.Offset < s.Offset+s.Length {
+						inLine = true
+						break
+					}
+				}
+				if !inLine {
+					continue
+				}
+				line.Words = append(line.Words, ocrWord{
+					Content:     w.Content,
+					Confidence:  w.Confidence,
+					Page:        p.PageNumber,
+					Polygon:     img.sourcePolygon(w.Polygon),
+					Offset:      w.Span.Offset,
+					Length:      w.Span.Length,
+					Handwritten: inSpans(w.Span.Offset, w.Span.Length, handwritten),
+				})
+			}
+			lines = append(lines, line)
+		}
+	}
+	return newOCRDocument(engineAzure, lines)
+}
+
+// normalizeRekognitionResult groups rekognition WORD detections under their LINE through ParentId. Their
+// geometry is given as a ratio of the image size and is converted into pixels of the source image.
+func normalizeRekognitionResult(out *rekognition.DetectTextOutput, img *preparedImage) *ocrDocument {
+	width, height := img.size()
+	polygonOf := func(t *rekognition.TextDetection) []float64 {
+		var polygon []float64
+		if t.Geometry != nil {
+			for _, p := range t.Geometry.Polygon {
+				polygon = append(polygon, aws.Float64Value(p.X)*width, aws.Float64Value(p.Y)*height)
+			}
+		}
+		return img.sourcePolygon(polygon)
+	}
+
+	var lines []ocrLine
+	lineIndex := map[int64]int{}
+	for _, t := range out.TextDetections {
+		if aws.StringValue(t.Type) == rekognition.TextTypesLine {
+			lineIndex[aws.Int64Value(t.Id)] = len(lines)
+			lines = append(lines, ocrLine{Page: 1, Polygon: polygonOf(t)})
+		}
+	}
+
+	for i, t := range out.TextDetections {
+		if aws.StringValue(t.Type) != rekognition.TextTypesWord {
+			continue
+		}
+		content := aws.StringValue(t.DetectedText)
+		w := ocrWord{
+			Content:    content,
+			Confidence: aws.Float64Value(t.Confidence) / 100,
+			Page:       1,
+			Polygon:    polygonOf(t),
+			Offset:     i,
+			Length:     len(content),
+		}
+
+		if idx, ok := lineIndex[aws.Int64Value(t.ParentId)]; ok && t.ParentId != nil {
+			lines[idx].Words = append(lines[idx].Words, w)
+		} else {
+			lines = append(lines, ocrLine{Page: 1, Polygon: w.Polygon, Words: []ocrWord{w}})
+		}
+	}
+
+	return newOCRDocument(engineRekognition, lines)
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"math"
+)
+
+const (
+	// rekognition rejects images passed as bytes above 5MB
+	rekognitionMaxImageBytes = 5 * 1024 * 1024
+	// azure read model accepts up to 10000px per side, keep well below it so uploads stay small
+	maxImageDimension = 4000
+	// images with more pixels are rejected before decoding, a small compressed file can decode to
+	// gigabytes
+	maxDecodePixels = 50 * 1000 * 1000
+	// skew smaller than this is left alone, rotating adds blur for no gain
+	minDeskewAngle = 0.5
+
+	defaultJPEGQuality = 90
+	minJPEGQuality     = 60
+)
+
+type preprocessOptions struct {
+	Grayscale       bool
+	EnhanceContrast bool
+	MaxBytes        int
+	MaxDimension    int
+}
+
+type preprocessReport struct {
+	OriginalWidth   int     `json:"originalWidth"`
+	OriginalHeight  int     `json:"originalHeight"`
+	OriginalBytes   int     `json:"originalBytes"`
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	Bytes           int     `json:"bytes"`
+	Orientation     int     `json:"exifOrientation"`
+	Scale           float64 `json:"scale"`
+	DeskewAngle     float64 `json:"deskewAngle"`
+	Grayscale       bool    `json:"grayscale"`
+	EnhanceContrast bool    `json:"enhanceContrast"`
+	// Undecoded is set for bytes sent to the providers as they are, a pdf or tiff for instance
+	Undecoded bool `json:"undecoded,omitempty"`
+}
+
+// preparedImage is a decoded document image along with the encoded bytes sent to the ocr providers.
+type preparedImage struct {
+	// Source is the upright image before resizing and enhancement
+	Source *image.NRGBA
+	Image  *image.NRGBA
+	Bytes  []byte
+	Report *preprocessReport
+	opts   preprocessOptions
+
+	// toSource maps a point of Image back onto Source
+	toSource func(x, y float64) (float64, float64)
+}
+
+func identityPoint(x, y float64) (float64, float64) {
+	return x, y
+}
+
+// decodeError is returned for bytes none of the registered decoders can read.
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("failed to decode image: %v", e.err)
+}
+
+// undecodedImage carries bytes the service cannot decode to the ocr providers as they are, the providers
+// read formats such as pdf, tiff or heic themselves.
+func undecodedImage(raw []byte) *preparedImage {
+	return &preparedImage{
+		Bytes:    raw,
+		Report:   &preprocessReport{OriginalBytes: len(raw), Bytes: len(raw), Scale: 1, Undecoded: true},
+		toSource: identityPoint,
+	}
+}
+
+// decoded tells whether Source and Image are set.
+func (p *preparedImage) decoded() bool {
+	return p.Image != nil
+}
+
+// size is the size of Image in pixels, polygons given as ratios of an undecoded image are kept as ratios.
+func (p *preparedImage) size() (float64, float64) {
+	if !p.decoded() {
+		return 1, 1
+	}
+	return float64(p.Image.Bounds().Dx()), float64(p.Image.Bounds().Dy())
+}
+
+// sourcePolygon maps a polygon given in Image pixels onto the upright source image.
+func (p *preparedImage) sourcePolygon(polygon []float64) []float64 {
+	mapped := make([]float64, len(polygon))
+	for i := 0; i+1 < len(polygon); i += 2 {
+		x, y := p.toSource(polygon[i], polygon[i+1])
+		mapped[i], mapped[i+1] = math.Round(x), math.Round(y)
+	}
+	return mapped
+}
+
+func defaultPreprocessOptions() preprocessOptions {
+	return preprocessOptions{
+		MaxBytes:     rekognitionMaxImageBytes,
+		MaxDimension: maxImageDimension,
+	}
+}
+
+// uploadFormats are the formats every ocr provider accepts as they are.
+var uploadFormats = map[string]bool{
+	"jpeg": true,
+	"png":  true,
+}
+
+// preprocessImage applies exif orientation, downsizes the image to provider limits and optionally
+// converts it to grayscale and stretches its contrast. An image needing none of it is sent as it is.
+func preprocessImage(raw []byte, opts preprocessOptions) (*preparedImage, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, &decodeError{err: err}
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxDecodePixels {
+		return nil, fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height)
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, &decodeError{err: err}
+	}
+
+	orientation := readEXIFOrientation(raw)
+	img := applyOrientation(toNRGBA(src), orientation)
+	source := img
+
+	report := &preprocessReport{
+		OriginalWidth:   img.Bounds().Dx(),
+		OriginalHeight:  img.Bounds().Dy(),
+		OriginalBytes:   len(raw),
+		Orientation:     orientation,
+		Scale:           1,
+		Grayscale:       opts.Grayscale,
+		EnhanceContrast: opts.EnhanceContrast,
+	}
+
+	toSource := identityPoint
+	if opts.MaxDimension > 0 {
+		w, h := img.Bounds().Dx(), img.Bounds().Dy()
+		if w > opts.MaxDimension || h > opts.MaxDimension {
+			scale := float64(opts.MaxDimension) / math.Max(float64(w), float64(h))
+			img = resizeImage(img, scale)
+			report.Scale = scale
+			toSource = func(x, y float64) (float64, float64) {
+				return x / scale, y / scale
+			}
+		}
+	}
+
+	if opts.Grayscale {
+		img = grayscaleImage(img)
+	}
+	if opts.EnhanceContrast {
+		img = stretchContrast(img)
+	}
+
+	p := &preparedImage{Source: source, Image: img, Report: report, opts: opts, toSource: toSource}
+	unchanged := orientation == 1 && report.Scale == 1 && !opts.Grayscale && !opts.EnhanceContrast
+	if unchanged && uploadFormats[format] && (opts.MaxBytes <= 0 || len(raw) <= opts.MaxBytes) {
+		// re-encoding would only grow the upload and add artifacts
+		p.Bytes = raw
+		report.Width, report.Height, report.Bytes = img.Bounds().Dx(), img.Bounds().Dy(), len(raw)
+		return p, nil
+	}
+	if err := p.encode(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// deskew returns a copy of the image rotated by the skew angle detected by ocr, angle is clockwise in degrees.
+func (p *preparedImage) deskew(angle float64) (*preparedImage, error) {
+	if !p.decoded() || math.Abs(angle) < minDeskewAngle {
+		return p, nil
+	}
+
+	report := *p.Report
+	report.DeskewAngle = angle
+
+	rotated := rotateImage(p.Image, angle)
+	rad := angle * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+	scx, scy := float64(p.Image.Bounds().Dx())/2, float64(p.Image.Bounds().Dy())/2
+	dcx, dcy := float64(rotated.Bounds().Dx())/2, float64(rotated.Bounds().Dy())/2
+
+	d := &preparedImage{Source: p.Source, Image: rotated, Report: &report, opts: p.opts}
+	d.toSource = func(x, y float64) (float64, float64) {
+		// same mapping rotateImage uses to sample the unrotated image
+		fx, fy := x-dcx, y-dcy
+		return p.toSource(fx*cos-fy*sin+scx, fx*sin+fy*cos+scy)
+	}
+	if err := d.encode(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// encode writes the image as jpeg, lowering the quality and then the size until it fits in MaxBytes.
+func (p *preparedImage) encode() error {
+	img := p.Image
+	quality := defaultJPEGQuality
+	for {
+		var buf bytes.Buffer
+		var err error
+		if p.opts.Grayscale {
+			err = jpeg.Encode(&buf, toGray(img), &jpeg.Options{Quality: quality})
+		} else {
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to encode image: %v", err)
+		}
+
+		if p.opts.MaxBytes <= 0 || buf.Len() <= p.opts.MaxBytes {
+			p.Image = img
+			p.Bytes = buf.Bytes()
+			p.Report.Width = img.Bounds().Dx()
+			p.Report.Height = img.Bounds().Dy()
+			p.Report.Bytes = buf.Len()
+			return nil
+		}
+
+		if quality > minJPEGQuality {
+			quality -= 10
+			continue
+		}
+
+		if img.Bounds().Dx() < 100 || img.Bounds().Dy() < 100 {
+			return fmt.Errorf("image does not fit in %d bytes", p.opts.MaxBytes)
+		}
+		img = resizeImage(img, 0.8)
+		p.Report.Scale *= 0.8
+		toSource := p.toSource
+		p.toSource = func(x, y float64) (float64, float64) {
+			return toSource(x/0.8, y/0.8)
+		}
+	}
+}
+
+// readEXIFOrientation returns the exif orientation tag of a jpeg, 1 when it is absent or unreadable.
+func readEXIFOrientation(raw []byte) int {
+	if len(raw) < 4 || raw[0] != 0xFF || raw[1] != 0xD8 {
+		return 1
+	}
+
+	i := 2
+	for i+4 <= len(raw) {
+		if raw[i] != 0xFF {
+			return 1
+		}
+		marker := raw[i+1]
+		// start of scan, no more metadata segments after it
+		if marker == 0xDA {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(raw[i+2 : i+4]))
+		if size < 2 || i+2+size > len(raw) {
+			return 1
+		}
+		segment := raw[i+4 : i+2+size]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return parseTIFFOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+
+	return 1
+}
+
+func parseTIFFOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+
+	return 1
+}
+
+func toNRGBA(src image.Image) *image.NRGBA {
+	if img, ok := src.(*image.NRGBA); ok && img.Bounds().Min == (image.Point{}) {
+		return img
+	}
+
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dst.Set(x, y, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+func toGray(src *image.NRGBA) *image.Gray {
+	b := src.Bounds()
+	dst := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(x, y, src.At(x, y))
+		}
+	}
+	return dst
+}
+
+// applyOrientation transforms the image so that it is displayed upright for the given exif orientation.
+func applyOrientation(src *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.SetNRGBA(dx, dy, src.NRGBAAt(x, y))
+		}
+	}
+	return dst
+}
+
+// resizeImage scales the image using area averaging, which keeps text legible when downsizing.
+func resizeImage(src *image.NRGBA, scale float64) *image.NRGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dw := int(math.Max(1, math.Round(float64(sw)*scale)))
+	dh := int(math.Max(1, math.Round(float64(sh)*scale)))
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	xr := float64(sw) / float64(dw)
+	yr := float64(sh) / float64(dh)
+	for y := 0; y < dh; y++ {
+		y0 := int(float64(y) * yr)
+		y1 := int(math.Max(float64(y0+1), math.Min(float64(sh), float64(y+1)*yr)))
+		for x := 0; x < dw; x++ {
+			x0 := int(float64(x) * xr)
+			x1 := int(math.Max(float64(x0+1), math.Min(float64(sw), float64(x+1)*xr)))
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := src.NRGBAAt(sx, sy)
+					r += uint32(c.R)
+					g += uint32(c.G)
+					b += uint32(c.B)
+					a += uint32(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// rotateImage rotates the image counter clockwise by angle degrees around its center, growing the canvas
+// to fit and filling the uncovered corners with white.
+func rotateImage(src *image.NRGBA, angle float64) *image.NRGBA {
+	rad := angle * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+
+	sw, sh := float64(src.Bounds().Dx()), float64(src.Bounds().Dy())
+	dw := int(math.Ceil(math.Abs(sw*cos) + math.Abs(sh*sin)))
+	dh := int(math.Ceil(math.Abs(sw*sin) + math.Abs(sh*cos)))
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	scx, scy := sw/2, sh/2
+	dcx, dcy := float64(dw)/2, float64(dh)/2
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// map the destination pixel back into the source image
+			fx, fy := float64(x)-dcx, float64(y)-dcy
+			sx := fx*cos - fy*sin + scx
+			sy := fx*sin + fy*cos + scy
+			if sx < 0 || sy < 0 || sx > sw-1 || sy > sh-1 {
+				dst.SetNRGBA(x, y, white)
+				continue
+			}
+			dst.SetNRGBA(x, y, bilinear(src, sx, sy))
+		}
+	}
+	return dst
+}
+
+func bilinear(src *image.NRGBA, x, y float64) color.NRGBA {
+	x0, y0 := int(x), int(y)
+	x1, y1 := x0+1, y0+1
+	if x1 >= src.Bounds().Dx() {
+		x1 = x0
+	}
+	if y1 >= src.Bounds().Dy() {
+		y1 = y0
+	}
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	c00, c10 := src.NRGBAAt(x0, y0), src.NRGBAAt(x1, y0)
+	c01, c11 := src.NRGBAAt(x0, y1), src.NRGBAAt(x1, y1)
+	mix := func(a, b, c, d uint8) uint8 {
+		top := float64(a)*(1-fx) + float64(b)*fx
+		bottom := float64(c)*(1-fx) + float64(d)*fx
+		return uint8(math.Round(top*(1-fy) + bottom*fy))
+	}
+	return color.NRGBA{
+		R: mix(c00.R, c10.R, c01.R, c11.R),
+		G: mix(c00.G, c10.G, c01.G, c11.G),
+		B: mix(c00.B, c10.B, c01.B, c11.B),
+		A: mix(c00.A, c10.A, c01.A, c11.A),
+	}
+}
+
+func luminance(c color.NRGBA) uint8 {
+	return uint8((299*uint32(c.R) + 587*uint32(c.G) + 114*uint32(c.B)) / 1000)
+}
+
+func grayscaleImage(src *image.NRGBA) *image.NRGBA {
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := src.NRGBAAt(x, y)
+			l := luminance(c)
+			dst.SetNRGBA(x, y, color.NRGBA{R: l, G: l, B: l, A: c.A})
+		}
+	}
+	return dst
+}
+
+// stretchContrast linearly maps the 1st..99th luminance percentiles onto the full 0..255 range.
+func stretchContrast(src *image.NRGBA) *image.NRGBA {
+	b := src.Bounds()
+	var hist [256]int
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			hist[luminance(src.NRGBAAt(x, y))]++
+		}
+	}
+
+	total := b.Dx() * b.Dy()
+	low, high := 0, 255
+	for n := 0; low < 255; low++ {
+		n += hist[low]
+		if n > total/100 {
+			break
+		}
+	}
+	for n := 0; high > 0; high-- {
+		n += hist[high]
+		if n > total/100 {
+			break
+		}
+	}
+	if high <= low {
+		return src
+	}
+
+	var lut [256]uint8
+	for i := range lut {
+		v := float64(i-low) * 255 / float64(high-low)
+		lut[i] = uint8(math.Max(0, math.Min(255, math.Round(v))))
+	}
+
+	dst := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := src.NRGBAAt(x, y)
+			dst.SetNRGBA(x, y, color.NRGBA{R: lut[c.R], G: lut[c.G], B: lut[c.B], A: c.A})
+		}
+	}
+	return dst
+}
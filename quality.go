@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// metrics are computed on a copy scaled down to this size so thresholds do not depend on the camera
+	qualitySampleDimension = 1000
+
+	minBlurVariance   = 60.0
+	minBrightness     = 50.0
+	maxBrightness     = 225.0
+	maxGlareRatio     = 0.04
+	minShortSide      = 480
+	minLongSide       = 640
+	minDocumentCover  = 0.25
+	glareLuminance    = 250
+	edgeMagnitude     = 60.0
+	edgeOutlierMargin = 0.02
+
+	// saturated spots smaller than this, in pixels of the sample, are white print or noise rather than glare
+	minGlareCluster = 25
+)
+
+const (
+	qualityBlurry       = "BLURRY"
+	qualityTooDark      = "TOO_DARK"
+	qualityTooBright    = "TOO_BRIGHT"
+	qualityGlare        = "GLARE"
+	qualityLowRes       = "LOW_RESOLUTION"
+	qualityDocTooSmall  = "DOCUMENT_TOO_SMALL"
+	qualityNoDocPresent = "NO_DOCUMENT"
+)
+
+type qualityReport struct {
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	BlurVariance   float64 `json:"blurVariance"`
+	Brightness     float64 `json:"brightness"`
+	GlareRatio     float64 `json:"glareRatio"`
+	DocumentCover  float64 `json:"documentCoverage"`
+	RetakeRequired bool    `json:"retakeRequired"`
+}
+
+type qualityIssue struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// qualityError is returned when the image is not good enough to be worth sending to ocr,
+// the client is expected to ask the user for another photo.
+type qualityError struct {
+	Issues []qualityIssue
+	Report *qualityReport
+}
+
+func (e *qualityError) Error() string {
+	codes := make([]string, 0, len(e.Issues))
+	for _, i := range e.Issues {
+		codes = append(codes, i.Code)
+	}
+	return fmt.Sprintf("image quality too low, retake required: %s", strings.Join(codes, ", "))
+}
+
+// assessQuality measures blur, exposure, glare, resolution and how much of the frame the document covers.
+func assessQuality(img *image.NRGBA) *qualityReport {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	report := &qualityReport{Width: w, Height: h}
+
+	sample := img
+	if w > qualitySampleDimension || h > qualitySampleDimension {
+		sample = resizeImage(img, float64(qualitySampleDimension)/math.Max(float64(w), float64(h)))
+	}
+	gray := luminanceGrid(sample)
+
+	report.BlurVariance = laplacianVariance(gray)
+	report.Brightness = meanLuminance(gray)
+	box, found := documentBox(gray)
+	if found {
+		report.DocumentCover = math.Round(float64(box.Dx()*box.Dy())/float64(len(gray)*len(gray[0]))*100) / 100
+	} else {
+		box = image.Rect(0, 0, len(gray[0]), len(gray))
+	}
+	report.GlareRatio = glareRatio(gray, box)
+
+	return report
+}
+
+// checkQuality returns a qualityError listing every threshold the image fails.
+func checkQuality(report *qualityReport) error {
+	var issues []qualityIssue
+
+	short, long := report.Width, report.Height
+	if short > long {
+		short, long = long, short
+	}
+	if short < minShortSide || long < minLongSide {
+		issues = append(issues, qualityIssue{
+			Code:    qualityLowRes,
+			Message: fmt.Sprintf("image is %dx%d, at least %dx%d is required", report.Width, report.Height, minLongSide, minShortSide),
+		})
+	}
+	if report.BlurVariance < minBlurVariance {
+		issues = append(issues, qualityIssue{Code: qualityBlurry, Message: "image is out of focus, hold the camera steady"})
+	}
+	if report.Brightness < minBrightness {
+		issues = append(issues, qualityIssue{Code: qualityTooDark, Message: "image is too dark, retake in better light"})
+	}
+	if report.Brightness > maxBrightness {
+		issues = append(issues, qualityIssue{Code: qualityTooBright, Message: "image is overexposed"})
+	}
+	if report.GlareRatio > maxGlareRatio {
+		issues = append(issues, qualityIssue{Code: qualityGlare, Message: "glare detected on the document, avoid direct light or flash"})
+	}
+	if report.DocumentCover == 0 {
+		issues = append(issues, qualityIssue{Code: qualityNoDocPresent, Message: "no document found in the image"})
+	} else if report.DocumentCover < minDocumentCover {
+		issues = append(issues, qualityIssue{Code: qualityDocTooSmall, Message: "document is too small, move the camera closer"})
+	}
+
+	if len(issues) == 0 {
+		return nil
+	}
+
+	report.RetakeRequired = true
+	return &qualityError{Issues: issues, Report: report}
+}
+
+func luminanceGrid(img *image.NRGBA) [][]float64 {
+	b := img.Bounds()
+	grid := make([][]float64, b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		grid[y] = make([]float64, b.Dx())
+		for x := 0; x < b.Dx(); x++ {
+			grid[y][x] = float64(luminance(img.NRGBAAt(b.Min.X+x, b.Min.Y+y)))
+		}
+	}
+	return grid
+}
+
+// laplacianVariance is the variance of the 3x3 laplacian response, sharp edges give high values.
+func laplacianVariance(gray [][]float64) float64 {
+	var sum, sumSq float64
+	n := 0
+	for y := 1; y < len(gray)-1; y++ {
+		for x := 1; x < len(gray[y])-1; x++ {
+			l := gray[y-1][x] + gray[y+1][x] + gray[y][x-1] + gray[y][x+1] - 4*gray[y][x]
+			sum += l
+			sumSq += l * l
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	mean := sum / float64(n)
+	return sumSq/float64(n) - mean*mean
+}
+
+func meanLuminance(gray [][]float64) float64 {
+	var sum float64
+	n := 0
+	for _, row := range gray {
+		for _, v := range row {
+			sum += v
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// glareRatio is the share of the document box covered by clusters of saturated pixels. A bright
+// background around the document and small white marks on it are not glare.
+func glareRatio(gray [][]float64, box image.Rectangle) float64 {
+	if box.Empty() {
+		return 0
+	}
+	w, h := box.Dx(), box.Dy()
+	seen := make([]bool, w*h)
+	saturated := func(x, y int) bool {
+		return gray[box.Min.Y+y][box.Min.X+x] >= glareLuminance
+	}
+
+	glare := 0
+	var stack []image.Point
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if seen[y*w+x] || !saturated(x, y) {
+				continue
+			}
+			// flood fill the 4-connected cluster of saturated pixels
+			size := 0
+			seen[y*w+x] = true
+			stack = append(stack[:0], image.Pt(x, y))
+			for len(stack) > 0 {
+				p := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				size++
+				for _, n := range [4]image.Point{{p.X - 1, p.Y}, {p.X + 1, p.Y}, {p.X, p.Y - 1}, {p.X, p.Y + 1}} {
+					if n.X < 0 || n.Y < 0 || n.X >= w || n.Y >= h || seen[n.Y*w+n.X] || !saturated(n.X, n.Y) {
+						continue
+					}
+					seen[n.Y*w+n.X] = true
+					stack = append(stack, n)
+				}
+			}
+			if size >= minGlareCluster {
+				glare += size
+			}
+		}
+	}
+	return float64(glare) / float64(w*h)
+}
+
+// documentBox estimates the area of the document from the bounding box of strong edges, ignoring a small
+// share of outlying edges on each side. It returns false when there are no edges at all.
+func documentBox(gray [][]float64) (image.Rectangle, bool) {
+	var xs, ys []int
+	for y := 1; y < len(gray)-1; y++ {
+		for x := 1; x < len(gray[y])-1; x++ {
+			gx := gray[y-1][x+1] + 2*gray[y][x+1] + gray[y+1][x+1] - gray[y-1][x-1] - 2*gray[y][x-1] - gray[y+1][x-1]
+			gy := gray[y+1][x-1] + 2*gray[y+1][x] + gray[y+1][x+1] - gray[y-1][x-1] - 2*gray[y-1][x] - gray[y-1][x+1]
+			if math.Hypot(gx, gy) > edgeMagnitude {
+				xs = append(xs, x)
+				ys = append(ys, y)
+			}
+		}
+	}
+	if len(xs) == 0 {
+		return image.Rectangle{}, false
+	}
+
+	sort.Ints(xs)
+	sort.Ints(ys)
+	cut := int(float64(len(xs)) * edgeOutlierMargin)
+	return image.Rect(xs[cut], ys[cut], xs[len(xs)-1-cut], ys[len(ys)-1-cut]), true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// syntheticCard draws a light card with rows of dark print on a darker background. The card takes the
+// given share of each side of the frame, centered.
+func syntheticCard(width int, height int, share float64, background uint8, card uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	fill(img, img.Bounds(), background)
+
+	cw, ch := int(float64(width)*share), int(float64(height)*share)
+	rect := image.Rect((width-cw)/2, (height-ch)/2, (width+cw)/2, (height+ch)/2)
+	fill(img, rect, card)
+	// print rows: dashes of 3px strokes, every 20px
+	for y := rect.Min.Y + 20; y+3 < rect.Max.Y-10; y += 20 {
+		for x := rect.Min.X + 20; x+12 < rect.Max.X-20; x += 16 {
+			fill(img, image.Rect(x, y, x+12, y+3), 20)
+		}
+	}
+	return img
+}
+
+func fill(img *image.NRGBA, r image.Rectangle, v uint8) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+}
+
+func issueCodes(err error) []string {
+	if err == nil {
+		return nil
+	}
+	var codes []string
+	for _, i := range err.(*qualityError).Issues {
+		codes = append(codes, i.Code)
+	}
+	return codes
+}
+
+func TestQualityThresholds(t *testing.T) {
+	glareSpot := syntheticCard(1000, 700, 0.8, 90, 180)
+	fill(glareSpot, image.Rect(300, 250, 500, 370), 255)
+
+	// saturated specks all over the card, none of them touching another
+	specks := syntheticCard(1000, 700, 0.8, 90, 180)
+	for y := 100; y < 600; y += 4 {
+		for x := 120; x < 880; x += 4 {
+			fill(specks, image.Rect(x, y, x+1, y+1), 255)
+		}
+	}
+
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+		want []string
+	}{
+		{"good", syntheticCard(1000, 700, 0.8, 90, 180), nil},
+		{"white background", syntheticCard(1000, 700, 0.8, 255, 180), nil},
+		{"glare on the card", glareSpot, []string{qualityGlare}},
+		{"white specks", specks, nil},
+		{"blurry", resizeImage(resizeImage(syntheticCard(1000, 700, 0.8, 90, 180), 0.05), 20), []string{qualityBlurry}},
+		{"dark", syntheticCard(1000, 700, 0.8, 20, 45), []string{qualityTooDark}},
+		{"overexposed", syntheticCard(1000, 700, 0.8, 245, 248), []string{qualityTooBright}},
+		{"low resolution", syntheticCard(400, 300, 0.8, 90, 180), []string{qualityLowRes}},
+		{"document too small", syntheticCard(1000, 700, 0.2, 90, 180), []string{qualityDocTooSmall}},
+		{"no document", syntheticCard(1000, 700, 0, 120, 120), []string{qualityBlurry, qualityNoDocPresent}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			report := assessQuality(tt.img)
+			got := issueCodes(checkQuality(report))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got issues %v, want %v for %+v", got, tt.want, report)
+			}
+		})
+	}
+}
+
+func TestGlareRatioIgnoresSmallClusters(t *testing.T) {
+	gray := make([][]float64, 100)
+	for y := range gray {
+		gray[y] = make([]float64, 100)
+	}
+	box := image.Rect(0, 0, 100, 100)
+
+	// a 4x4 spot is below the cluster size, a 5x5 one is not
+	for y := 10; y < 14; y++ {
+		for x := 10; x < 14; x++ {
+			gray[y][x] = 255
+		}
+	}
+	if r := glareRatio(gray, box); r != 0 {
+		t.Errorf("got glare ratio %v for a small spot", r)
+	}
+	for y := 50; y < 55; y++ {
+		for x := 50; x < 55; x++ {
+			gray[y][x] = 255
+		}
+	}
+	if r := glareRatio(gray, box); r != 0.0025 {
+		t.Errorf("got glare ratio %v, want 0.0025", r)
+	}
+	// only the box is looked at
+	if r := glareRatio(gray, image.Rect(0, 0, 40, 40)); r != 0 {
+		t.Errorf("got glare ratio %v outside the box", r)
+	}
+}
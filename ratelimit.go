@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bureau-Inc/overwatch-common/logger"
+	"github.com/Bureau-Inc/overwatch-common/logger/tag"
+)
+
+const providerOpenAI = "openai"
+
+// defaultRateLimits are the requests per second allowed to each provider, under the default quotas of
+// the accounts. PROVIDER_RATE_LIMITS overrides them, e.g. PROVIDER_RATE_LIMITS=azure=10,openai=5, and 0
+// turns the limit of a provider off.
+var defaultRateLimits = map[string]float64{
+	engineAzure:       15,
+	engineRekognition: 5,
+	engineTextract:    5,
+	providerOpenAI:    10,
+}
+
+// rateLimiter spaces the calls to a provider evenly. The limit holds per process only: concurrent lambdas
+// each get their own, so a provider sees up to the limit times the concurrency of the function. Keep the
+// reserved concurrency of the function times the limits below the provider quotas, lowering
+// PROVIDER_RATE_LIMITS when the concurrency is raised.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+var (
+	rateLimitsOnce sync.Once
+	rateLimiters   map[string]*rateLimiter
+)
+
+func rateLimitsFor() map[string]*rateLimiter {
+	rateLimitsOnce.Do(func() {
+		limits := map[string]float64{}
+		for provider, rps := range defaultRateLimits {
+			limits[provider] = rps
+		}
+		for _, pair := range strings.Split(os.Getenv("PROVIDER_RATE_LIMITS"), ",") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			rps, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+			if err != nil || rps < 0 {
+				logger.ERROR("invalid provider rate limit", tag.NewStringTag("limit", pair))
+				continue
+			}
+			limits[strings.ToLower(strings.TrimSpace(kv[0]))] = rps
+		}
+
+		rateLimiters = map[string]*rateLimiter{}
+		for provider, rps := range limits {
+			if rps > 0 {
+				rateLimiters[provider] = &rateLimiter{interval: time.Duration(float64(time.Second) / rps)}
+			}
+		}
+	})
+	return rateLimiters
+}
+
+// waitForProvider blocks until the next call to the provider is allowed.
+func waitForProvider(provider string) {
+	l := rateLimitsFor()[provider]
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	sleep(wait)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	redactFormatPNG  = "png"
+	redactFormatJPEG = "jpeg"
+
+	// pixels added around every mask so anti aliased glyph edges are covered too
+	redactPadding = 3
+)
+
+type redactField struct {
+	Field string `json:"field"`
+	// KeepLast leaves the last characters of the value readable, 0 masks all of it
+	KeepLast int `json:"keepLast"`
+}
+
+type redactOptions struct {
+	// Fields to mask, defaults to the document number rules of the doc type when empty
+	Fields []redactField `json:"fields"`
+	Format string        `json:"format"`
+}
+
+type redactionResult struct {
+	Format string `json:"format"`
+	S3URI  string `json:"s3Uri,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+	// Fields were masked, Unmasked have a value that was not found on the image. The image is withheld
+	// when any field is unmasked and the redaction marked incomplete.
+	Fields      []string `json:"fields"`
+	Unmasked    []string `json:"unmasked,omitempty"`
+	Incomplete  bool     `json:"incomplete,omitempty"`
+	MaskedAreas int      `json:"maskedAreas"`
+}
+
+// defaultRedactFields masks the aadhaar number except its last 4 digits, as UIDAI requires for stored copies.
+var defaultRedactFields = map[string][]redactField{
+	aadharDoc: {{Field: "docNumber", KeepLast: 4}},
+	panDoc:    {{Field: "docNumber"}},
+}
+
+// redactBucket is the bucket redacted images are uploaded to, they are returned as base64 when it is not
+// configured.
+func redactBucket() string {
+	return os.Getenv("REDACT_BUCKET")
+}
+
+// redactDocument draws black boxes over every occurrence of the configured field values on a copy of the
+// source image and uploads it to s3 or returns it as base64.
+func redactDocument(img *preparedImage, fields map[string]interface{}, docs []*ocrDocument, docType string, opts *redactOptions) (*redactionResult, error) {
+	rules := opts.Fields
+	if len(rules) == 0 {
+		rules = defaultRedactFields[docType]
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no fields to redact for doc type %s", docType)
+	}
+
+	format := strings.ToLower(opts.Format)
+	if format == "" || format == "jpg" {
+		format = redactFormatJPEG
+	}
+	if format != redactFormatPNG && format != redactFormatJPEG {
+		return nil, fmt.Errorf("unsupported redaction format: %s", opts.Format)
+	}
+
+	var masks [][]float64
+	result := &redactionResult{Format: format}
+	for _, rule := range rules {
+		v, ok := fields[rule.Field]
+		if !ok || isMissingValue(v) {
+			continue
+		}
+		value, ok := v.(string)
+		if !ok {
+			result.Unmasked = append(result.Unmasked, rule.Field)
+			continue
+		}
+
+		n := len(masks)
+		for _, doc := range docs {
+			for _, run := range matchRuns(value, doc) {
+				masks = append(masks, maskWords(doc.Words[run.Start:run.End+1], rule.KeepLast)...)
+			}
+		}
+		if len(masks) == n {
+			result.Unmasked = append(result.Unmasked, rule.Field)
+			continue
+		}
+		result.Fields = append(result.Fields, rule.Field)
+	}
+	result.MaskedAreas = len(masks)
+	if len(result.Unmasked) > 0 {
+		// the image still shows the value, returning it would leak what the caller asked to hide
+		result.Incomplete = true
+		return result, nil
+	}
+
+	if !img.decoded() {
+		// there is no decoded image to draw the masks on
+		result.Incomplete = true
+		return result, nil
+	}
+
+	redacted := image.NewNRGBA(img.Source.Bounds())
+	copy(redacted.Pix, img.Source.Pix)
+	for _, m := range masks {
+		fillPolygon(redacted, m, redactPadding)
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if format == redactFormatPNG {
+		err = png.Encode(&buf, redacted)
+	} else {
+		err = jpeg.Encode(&buf, redacted, &jpeg.Options{Quality: defaultJPEGQuality})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode redacted image: %v", err)
+	}
+
+	bucket := redactBucket()
+	if bucket == "" {
+		result.Base64 = base64.StdEncoding.EncodeToString(buf.Bytes())
+		return result, nil
+	}
+
+	sum := sha256.Sum256(img.Bytes)
+	key := fmt.Sprintf("redacted/%s.%s", hex.EncodeToString(sum[:]), format)
+	if err := uploadToS3(bucket, key, buf.Bytes(), "image/"+format); err != nil {
+		return nil, fmt.Errorf("failed to upload redacted image: %v", err)
+	}
+	result.S3URI = fmt.Sprintf("s3://%s/%s", bucket, key)
+
+	return result, nil
+}
+
+// maskWords returns the polygons to black out for the words of a value, leaving the last keepLast
+// letters or digits visible. Partially masked words are cut proportionally to their character count.
+func maskWords(words []ocrWord, keepLast int) [][]float64 {
+	total := 0
+	for _, w := range words {
+		total += countAlnum(w.Content)
+	}
+	toMask := total - keepLast
+	if keepLast <= 0 {
+		toMask = total
+	}
+
+	var masks [][]float64
+	for _, w := range words {
+		if toMask <= 0 {
+			break
+		}
+		if len(w.Polygon) < 8 {
+			continue
+		}
+
+		n := countAlnum(w.Content)
+		if n <= toMask {
+			masks = append(masks, w.Polygon)
+			toMask -= n
+			continue
+		}
+
+		// mask up to and including the toMask-th letter or digit of the word
+		runes := []rune(w.Content)
+		seen, cut := 0, len(runes)
+		for i, r := range runes {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				seen++
+				if seen == toMask {
+					cut = i + 1
+					break
+				}
+			}
+		}
+		masks = append(masks, leadingPart(w.Polygon, float64(cut)/float64(len(runes))))
+		toMask = 0
+	}
+	return masks
+}
+
+func countAlnum(s string) int {
+	n := 0
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// leadingPart returns the first fraction of a 4 point word polygon along its reading direction.
+func leadingPart(polygon []float64, fraction float64) []float64 {
+	lerp := func(a, b float64) float64 {
+		return a + (b-a)*fraction
+	}
+	// points are top-left, top-right, bottom-right, bottom-left
+	return []float64{
+		polygon[0], polygon[1],
+		lerp(polygon[0], polygon[2]), lerp(polygon[1], polygon[3]),
+		lerp(polygon[6], polygon[4]), lerp(polygon[7], polygon[5]),
+		polygon[6], polygon[7],
+	}
+}
+
+// fillPolygon paints the polygon black, grown by padding pixels on every side.
+func fillPolygon(img *image.NRGBA, polygon []float64, padding float64) {
+	box := boundingPolygon(polygon)
+	if box == nil {
+		return
+	}
+
+	// grow the polygon from its centroid so that rotated words stay covered
+	cx, cy := 0.0, 0.0
+	n := len(polygon) / 2
+	for i := 0; i < n; i++ {
+		cx += polygon[2*i]
+		cy += polygon[2*i+1]
+	}
+	cx, cy = cx/float64(n), cy/float64(n)
+	grown := make([]float64, len(polygon))
+	for i := 0; i < n; i++ {
+		dx, dy := polygon[2*i]-cx, polygon[2*i+1]-cy
+		d := math.Hypot(dx, dy)
+		if d == 0 {
+			grown[2*i], grown[2*i+1] = polygon[2*i], polygon[2*i+1]
+			continue
+		}
+		grown[2*i] = polygon[2*i] + dx/d*padding*math.Sqrt2
+		grown[2*i+1] = polygon[2*i+1] + dy/d*padding*math.Sqrt2
+	}
+
+	b := img.Bounds()
+	x0 := int(math.Max(float64(b.Min.X), math.Floor(box[0]-2*padding)))
+	y0 := int(math.Max(float64(b.Min.Y), math.Floor(box[1]-2*padding)))
+	x1 := int(math.Min(float64(b.Max.X), math.Ceil(box[4]+2*padding)))
+	y1 := int(math.Min(float64(b.Max.Y), math.Ceil(box[5]+2*padding)))
+
+	black := color.NRGBA{A: 255}
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			if pointInPolygon(float64(x)+0.5, float64(y)+0.5, grown) {
+				img.SetNRGBA(x, y, black)
+			}
+		}
+	}
+}
+
+func pointInPolygon(x, y float64, polygon []float64) bool {
+	inside := false
+	n := len(polygon) / 2
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		xi, yi := polygon[2*i], polygon[2*i+1]
+		xj, yj := polygon[2*j], polygon[2*j+1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func uploadToS3(bucket string, key string, body []byte, contentType string) error {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String("ap-south-1"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+
+	_, err = s3.New(sess).PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	providersStub = "stub"
+	providersLive = "live"
+	// providersRecord calls the live providers and records them in the cassette of the fixture,
+	// providersCassette answers from it offline
+	providersRecord   = "record"
+	providersCassette = "cassette"
+
+	// a fixture name.json has its expected response in name.expected.json and its stubs in name.stub.json
+	expectedSuffix = ".expected.json"
+	stubSuffix     = ".stub.json"
+)
+
+// providerStubs stand in for the image hosts, the ocr engines and the llm while replaying a fixture.
+// Images maps the urls of the request to files next to the fixture, OCR the engines to the text they
+// read, one line per ocr line, and LLM holds the llm answers in the order the calls are made, the last
+// one answering any further calls.
+type providerStubs struct {
+	Images map[string]string `json:"images"`
+	OCR    map[string]string `json:"ocr"`
+	LLM    []stubLLMAnswer   `json:"llm"`
+
+	dir   string
+	mu    sync.Mutex
+	calls int
+}
+
+type stubLLMAnswer struct {
+	Content string `json:"content"`
+	Usage   Usage  `json:"usage"`
+}
+
+// replayExpectation is the response a fixture is expected to get.
+type replayExpectation struct {
+	StatusCode int             `json:"statusCode"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// stubs replace the providers when set, only the replay command sets them.
+var stubs *providerStubs
+
+func loadProviderStubs(path string) (*providerStubs, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stubs: %v", err)
+	}
+	s := &providerStubs{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("failed to decode stubs: %v", err)
+	}
+	s.dir = filepath.Dir(path)
+	return s, nil
+}
+
+func (s *providerStubs) image(url string) ([]byte, error) {
+	file, ok := s.Images[url]
+	if !ok {
+		return nil, fmt.Errorf("no stub image for %s", url)
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(s.dir, file)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stub image: %v", err)
+	}
+	return b, nil
+}
+
+// ocr lays the stub text out as full width lines down the page, so that the reading order is the order
+// of the text.
+func (s *providerStubs) ocr(engine string, img *preparedImage) (*engineRun, error) {
+	text, ok := s.OCR[engine]
+	if !ok {
+		return nil, fmt.Errorf("no stub ocr text for %s", engine)
+	}
+
+	width, height := img.size()
+	rows := strings.Split(strings.TrimSpace(text), "\n")
+	rowHeight := height / float64(len(rows)+1)
+
+	var lines []ocrLine
+	for i, row := range rows {
+		words := strings.Fields(row)
+		if len(words) == 0 {
+			continue
+		}
+		top := rowHeight * (float64(i) + 0.5)
+		bottom := top + rowHeight*0.8
+		line := ocrLine{Page: 1, Polygon: []float64{0, top, width, top, width, bottom, 0, bottom}}
+		wordWidth := width / float64(len(words))
+		for j, w := range words {
+			left, right := wordWidth*float64(j), wordWidth*float64(j+1)
+			line.Words = append(line.Words, ocrWord{
+				Content:    w,
+				Confidence: 1,
+				Page:       1,
+				Polygon:    []float64{left, top, right, top, right, bottom, left, bottom},
+			})
+		}
+		lines = append(lines, line)
+	}
+
+	run := &engineRun{Engine: engine, Doc: newOCRDocument(engine, lines), Pages: 1}
+	run.Score = fetchCombinedNormalizedConfidenceScore(run.Doc)
+	return run, nil
+}
+
+func (s *providerStubs) llm() (string, Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.LLM) == 0 {
+		return "", Usage{}, fmt.Errorf("no stub llm answer")
+	}
+	i := s.calls
+	if i >= len(s.LLM) {
+		i = len(s.LLM) - 1
+	}
+	s.calls++
+	return s.LLM[i].Content, s.LLM[i].Usage, nil
+}
+
+// runReplay feeds api gateway request fixtures through HandleRequest and compares the responses with
+// the expected ones, e.g. nergpt replay testdata/replay. Directories are searched for fixtures.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	providers := fs.String("providers", providersStub, "stub to answer from the .stub.json of each fixture, cassette from its .cassette.json, live to call the providers and record to also record them")
+	update := fs.Bool("update", false, "write the responses as the expected ones")
+	ignore := fs.String("ignore", "", "comma separated fields left out of the comparison, e.g. _meta.usage")
+	quiet := fs.Bool("quiet", false, "only print the fixtures that differ")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	switch *providers {
+	case providersStub, providersLive, providersRecord, providersCassette:
+	default:
+		fmt.Fprintf(os.Stderr, "unsupported providers: %s\n", *providers)
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "give the fixtures or directories to replay")
+		return 2
+	}
+
+	fixtures, err := findFixtures(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// replays have to answer the same every time
+	os.Setenv("CACHE_STORE", cacheStoreNone)
+	metricsOut = io.Discard
+	allowLocalFiles = true
+
+	var passed, failed, unchecked int
+	for _, path := range fixtures {
+		base := strings.TrimSuffix(path, ".json")
+		resp, err := replayFixture(path, *providers)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", path, err)
+			failed++
+			continue
+		}
+		if !*quiet {
+			fmt.Printf("== %s: %d\n%s\n", path, resp.StatusCode, indentJSON([]byte(resp.Body)))
+		}
+
+		got := replayExpectation{StatusCode: resp.StatusCode, Body: rawBody(resp.Body)}
+		if *update {
+			b, _ := json.MarshalIndent(got, "", "  ")
+			if err := os.WriteFile(base+expectedSuffix, append(b, '\n'), 0o644); err != nil {
+				fmt.Printf("FAIL %s: failed to write expected response: %v\n", path, err)
+				failed++
+				continue
+			}
+			fmt.Printf("UPDATED %s\n", base+expectedSuffix)
+			passed++
+			continue
+		}
+
+		b, err := os.ReadFile(base + expectedSuffix)
+		if os.IsNotExist(err) {
+			if !*quiet {
+				fmt.Printf("NO EXPECTED RESPONSE %s\n", path)
+			}
+			unchecked++
+			continue
+		}
+		want := replayExpectation{}
+		if err == nil {
+			err = json.Unmarshal(b, &want)
+		}
+		if err != nil {
+			fmt.Printf("FAIL %s: failed to read expected response: %v\n", path, err)
+			failed++
+			continue
+		}
+
+		if diff := diffResponses(want, got, splitList(*ignore)); diff != "" {
+			fmt.Printf("FAIL %s\n%s\n", path, diff)
+			failed++
+			continue
+		}
+		if !*quiet {
+			fmt.Printf("PASS %s\n", path)
+		}
+		passed++
+	}
+
+	fmt.Printf("%d passed, %d failed, %d without expected response\n", passed, failed, unchecked)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// findFixtures returns the files given and the request fixtures of the directories, sorted.
+func findFixtures(paths []string) ([]string, error) {
+	var fixtures []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", p, err)
+		}
+		if !info.IsDir() {
+			fixtures = append(fixtures, p)
+			continue
+		}
+		err = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(path, ".json") || strings.HasSuffix(path, expectedSuffix) ||
+				strings.HasSuffix(path, stubSuffix) || strings.HasSuffix(path, cassetteSuffix) {
+				return nil
+			}
+			fixtures = append(fixtures, path)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", p, err)
+		}
+	}
+	sort.Strings(fixtures)
+	return fixtures, nil
+}
+
+func replayFixture(path string, providers string) (events.APIGatewayProxyResponse, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to read fixture: %v", err)
+	}
+	req := events.APIGatewayProxyRequest{}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to decode fixture: %v", err)
+	}
+
+	base := strings.TrimSuffix(path, ".json")
+	stubs = nil
+	switch providers {
+	case providersStub:
+		s, err := loadProviderStubs(base + stubSuffix)
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+		stubs = s
+		defer func() { stubs = nil }()
+	case providersCassette:
+		c, err := loadCassette(base + cassetteSuffix)
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, fmt.Errorf("%v, record it with --providers record", err)
+		}
+		defer useCassette(c)()
+	case providersRecord:
+		c := &cassette{mode: cassetteRecord}
+		restore := useCassette(c)
+		resp, err := HandleRequest(req)
+		restore()
+		if err != nil {
+			return resp, err
+		}
+		return resp, c.save(base + cassetteSuffix)
+	}
+
+	return HandleRequest(req)
+}
+
+// rawBody keeps a json body as it is and quotes any other body.
+func rawBody(body string) json.RawMessage {
+	if json.Valid([]byte(body)) {
+		return json.RawMessage(body)
+	}
+	b, _ := json.Marshal(body)
+	return b
+}
+
+func indentJSON(b []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(b)
+	}
+	out, _ := json.MarshalIndent(v, "", "  ")
+	return string(out)
+}
+
+// diffResponses compares the status and the decoded bodies, returning a line diff of the bodies when
+// they differ. The ignored fields are dotted paths into the body.
+func diffResponses(want replayExpectation, got replayExpectation, ignore []string) string {
+	var sb strings.Builder
+	if want.StatusCode != got.StatusCode {
+		fmt.Fprintf(&sb, "status: want %d, got %d\n", want.StatusCode, got.StatusCode)
+	}
+
+	var w, g interface{}
+	json.Unmarshal(want.Body, &w)
+	json.Unmarshal(got.Body, &g)
+	for _, path := range ignore {
+		w = withoutField(w, strings.Split(path, "."))
+		g = withoutField(g, strings.Split(path, "."))
+	}
+	if !reflect.DeepEqual(w, g) {
+		wb, _ := json.MarshalIndent(w, "", "  ")
+		gb, _ := json.MarshalIndent(g, "", "  ")
+		sb.WriteString(diffLines(strings.Split(string(wb), "\n"), strings.Split(string(gb), "\n")))
+	}
+	return sb.String()
+}
+
+func withoutField(v interface{}, path []string) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(path) == 0 {
+		return v
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, val := range m {
+		out[k] = val
+	}
+	if len(path) == 1 {
+		delete(out, path[0])
+	} else if child, ok := out[path[0]]; ok {
+		out[path[0]] = withoutField(child, path[1:])
+	}
+	return out
+}
+
+// diffLines returns the lines only in a prefixed with - and the lines only in b prefixed with +, in the
+// order of a longest common subsequence.
+func diffLines(a []string, b []string) string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&sb, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&sb, "+ %s\n", b[j])
+			j++
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestMain(m *testing.M) {
+	// the fixtures are answered the same every time, nothing is served from a cache
+	os.Setenv("CACHE_STORE", cacheStoreNone)
+	metricsOut = io.Discard
+	os.Exit(m.Run())
+}
+
+func readExpectation(t *testing.T, path string) replayExpectation {
+	t.Helper()
+	b, err := os.ReadFile(strings.TrimSuffix(path, ".json") + expectedSuffix)
+	if err != nil {
+		t.Fatalf("failed to read expected response: %v", err)
+	}
+	want := replayExpectation{}
+	if err := json.Unmarshal(b, &want); err != nil {
+		t.Fatalf("failed to decode expected response: %v", err)
+	}
+	return want
+}
+
+// TestGoldenCassettes runs the analysis of each golden fixture against its recorded provider calls and
+// checks every recorded call was made.
+func TestGoldenCassettes(t *testing.T) {
+	fixtures, err := findFixtures([]string{"testdata/golden"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no golden fixtures")
+	}
+
+	for _, path := range fixtures {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read fixture: %v", err)
+			}
+			req := events.APIGatewayProxyRequest{}
+			if err := json.Unmarshal(b, &req); err != nil {
+				t.Fatalf("failed to decode fixture: %v", err)
+			}
+			input := &payload{}
+			if err := json.Unmarshal([]byte(req.Body), input); err != nil {
+				t.Fatalf("failed to decode payload: %v", err)
+			}
+
+			c, err := loadCassette(strings.TrimSuffix(path, ".json") + cassetteSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer useCassette(c)()
+
+			analysis, err := doDocAnalysis(input.FrontURL, strings.ToUpper(input.DocType), input.OutputFields, input.analysisOptions())
+			if err != nil {
+				t.Fatalf("failed to analyse document: %v", err)
+			}
+			body, err := json.Marshal(analysis.response())
+			if err != nil {
+				t.Fatalf("failed to encode analysis: %v", err)
+			}
+
+			got := replayExpectation{StatusCode: http.StatusOK, Body: body}
+			if diff := diffResponses(readExpectation(t, path), got, nil); diff != "" {
+				t.Errorf("analysis differs from the expected response\n%s", diff)
+			}
+			for _, in := range c.HTTP {
+				if !in.used {
+					t.Errorf("recorded call not made: %s %s", in.Method, in.URL)
+				}
+			}
+			for _, in := range c.Rekognition {
+				if !in.used {
+					t.Errorf("recorded rekognition call not made for image %s", in.ImageSHA256)
+				}
+			}
+		})
+	}
+}
+
+// TestReplayFixtures replays the request fixtures with their stubbed providers.
+func TestReplayFixtures(t *testing.T) {
+	fixtures, err := findFixtures([]string{"testdata/replay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range fixtures {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			resp, err := replayFixture(path, providersStub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := replayExpectation{StatusCode: resp.StatusCode, Body: rawBody(resp.Body)}
+			if diff := diffResponses(readExpectation(t, path), got, nil); diff != "" {
+				t.Errorf("response differs from the expected one\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// extractorLLM leaves every field to the llm
+	extractorLLM = "llm"
+	// extractorHybrid fills the fields the rules are confident about and asks the llm only when some are missing
+	extractorHybrid = "hybrid"
+	// extractorRules never calls the llm, which together with tesseract runs fully offline
+	extractorRules = "rules"
+
+	// rule values below this confidence are left to the llm in the hybrid mode
+	minRuleConfidence = 0.8
+)
+
+// ruleValue is a field value found by the rules, with the document it was read from.
+type ruleValue struct {
+	Value      string
+	Confidence float64
+	Source     int
+}
+
+var (
+	datePattern       = regexp.MustCompile(`\b(\d{2})[/\-.](\d{2})[/\-.](\d{4})\b`)
+	dobLabelPattern   = regexp.MustCompile(`(?i)(DOB|D\.O\.B|Date of Birth|जन्म तिथि)[^0-9]*(\d{2}[/\-.]\d{2}[/\-.]\d{4})`)
+	yobPattern        = regexp.MustCompile(`(?i)(Year of Birth|YOB|जन्म वर्ष)[^0-9]*(\d{4})\b`)
+	aadhaarPattern    = regexp.MustCompile(`(^|[^\d])(\d{4})\s?(\d{4})\s?(\d{4})([^\d]|$)`)
+	vidPattern        = regexp.MustCompile(`\d{4}\s?\d{4}\s?\d{4}\s?\d{4}`)
+	genderPattern     = regexp.MustCompile(`(?i)\b(FEMALE|MALE|TRANSGENDER)\b|(पुरुष|महिला)`)
+	issueDatePattern  = regexp.MustCompile(`(^|[^\d])(\d{8})([^\d]|$)`)
+	personNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z.' ]+[A-Za-z]$`)
+	fieldLabelPattern = regexp.MustCompile(`(?i)\b(name|father|date|birth|dob|yob|sex|gender|male|female)\b`)
+
+	dobLabelStart  = regexp.MustCompile(`(?i)(DOB|D\.O\.B|Date of Birth|Year of Birth|YOB)`)
+	panNameLabel   = regexp.MustCompile(`(?i)^(.*/\s*)?name$`)
+	panFatherLabel = regexp.MustCompile(`(?i)father'?s?\s*name`)
+)
+
+// required fields of each doc type, the hybrid mode skips the llm when the rules found all of them
+var ruleFields = map[string][]string{
+	panDoc:    {"fullName", "fatherName", "dateOfBirth", "docNumber"},
+	aadharDoc: {"fullName", "dateOfBirth", "docNumber", "gender"},
+}
+
+// fields the llm prompt of each doc type answers, the hybrid mode only asks for those the rules missed
+var promptFields = map[string][]string{
+	panDoc:    {"fullName", "fatherName", "dateOfBirth", "docNumber", "issueDate"},
+	aadharDoc: {"fullName", "dateOfBirth", "docNumber", "gender"},
+}
+
+// doc type as the llm prompts return it, the rules and the structured models return it the same way
+var ruleDocTypes = map[string]string{
+	panDoc:    "PAN",
+	aadharDoc: "aadhaar",
+}
+
+// latin text lines printed as headers of the cards, never a name
+var headerLines = []string{"income tax department", "govt of india", "government of india", "permanent account number", "signature", "unique identification authority"}
+
+func extractorFor(override string, docType string) (string, error) {
+	extractor := strings.ToLower(override)
+	if extractor == "" {
+		extractor = strings.ToLower(os.Getenv("EXTRACTOR"))
+	}
+
+	switch extractor {
+	case "", extractorLLM:
+		return extractorLLM, nil
+	case extractorHybrid:
+		if _, ok := ruleFields[docType]; !ok {
+			return extractorLLM, nil
+		}
+		return extractor, nil
+	case extractorRules:
+		if _, ok := ruleFields[docType]; !ok {
+			return "", fmt.Errorf("rules extractor does not support docType %s", docType)
+		}
+		return extractor, nil
+	}
+	return "", fmt.Errorf("unsupported extractor: %s", override)
+}
+
+// extractWithRules runs the rules of the doc type on every document and keeps the most confident value
+// of each field.
+func extractWithRules(docs []*ocrDocument, docType string) map[string]ruleValue {
+	values := map[string]ruleValue{}
+	for i, doc := range docs {
+		var found map[string]ruleValue
+		switch docType {
+		case panDoc:
+			found = panRules(doc)
+		case aadharDoc:
+			found = aadhaarRules(doc)
+		}
+		for k, v := range found {
+			v.Source = i
+			if cur, ok := values[k]; !ok || v.Confidence > cur.Confidence {
+				values[k] = v
+			}
+		}
+	}
+	return values
+}
+
+// rulesComplete tells whether the rules confidently found every required field of the doc type.
+func rulesComplete(values map[string]ruleValue, docType string) bool {
+	for _, f := range ruleFields[docType] {
+		if v, ok := values[f]; !ok || v.Confidence < minRuleConfidence {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleGaps lists the prompt fields the rules did not find or are not confident about.
+func ruleGaps(values map[string]ruleValue, docType string) []string {
+	var gaps []string
+	for _, f := range promptFields[docType] {
+		if v, ok := values[f]; !ok || v.Confidence < minRuleConfidence {
+			gaps = append(gaps, f)
+		}
+	}
+	return gaps
+}
+
+// ruleExtraction builds the fields the way the llm returns them, every required key being present.
+func ruleExtraction(values map[string]ruleValue, docType string, sources int) *extraction {
+	ex := &extraction{Fields: map[string]interface{}{"docType": ruleDocTypes[docType]}}
+	for _, f := range ruleFields[docType] {
+		ex.Fields[f] = "nil"
+	}
+
+	counts := make([]int, sources)
+	for k, v := range values {
+		ex.Fields[k] = v.Value
+		counts[v.Source]++
+	}
+
+	best := 0
+	for i, c := range counts {
+		if c > counts[best] {
+			best = i
+		}
+	}
+	ex.Order = []int{best}
+	for i := 0; i < sources; i++ {
+		if i != best {
+			ex.Order = append(ex.Order, i)
+		}
+	}
+	return ex
+}
+
+// overlayRules replaces the llm values with the rule values the rules are confident about and returns
+// the fields that were taken from the rules.
+func overlayRules(fields map[string]interface{}, values map[string]ruleValue) []string {
+	var used []string
+	for k, v := range values {
+		if v.Confidence < minRuleConfidence && !isMissingValue(fields[k]) {
+			continue
+		}
+		fields[k] = v.Value
+		used = append(used, k)
+	}
+	return used
+}
+
+// ruleLine is a line of the document with its latin text, native words left out.
+type ruleLine struct {
+	text       string
+	all        string
+	confidence float64
+}
+
+func ruleLines(doc *ocrDocument) []ruleLine {
+	lines := make([]ruleLine, 0, len(doc.Lines))
+	for _, l := range doc.Lines {
+		var latin []string
+		for _, w := range l.Words {
+			if !isNativeScript(w.Content) {
+				latin = append(latin, w.Content)
+			}
+		}
+		lines = append(lines, ruleLine{
+			text:       strings.TrimSpace(strings.Join(latin, " ")),
+			all:        l.content(),
+			confidence: meanConfidence(l.Words),
+		})
+	}
+	return lines
+}
+
+func panRules(doc *ocrDocument) map[string]ruleValue {
+	values := map[string]ruleValue{}
+	lines := ruleLines(doc)
+
+	dobLine := -1
+	for i, l := range lines {
+		for _, token := range strings.Fields(l.text) {
+			if pan, fixed, ok := fixPAN(token); ok {
+				conf := l.confidence
+				if fixed {
+					conf *= 0.85
+				}
+				setRuleValue(values, "docNumber", pan, conf)
+			}
+		}
+
+		if m := datePattern.FindStringSubmatch(l.text); m != nil && validDate(m[1], m[2], m[3]) && dobLine < 0 {
+			dobLine = i
+			setRuleValue(values, "dateOfBirth", m[0], l.confidence)
+		}
+		if m := issueDatePattern.FindStringSubmatch(l.text); m != nil {
+			d := m[2]
+			if validDate(d[0:2], d[2:4], d[4:8]) {
+				setRuleValue(values, "issueDate", d[0:2]+"/"+d[2:4]+"/"+d[4:8], 0.7*l.confidence)
+			}
+		}
+
+		// new cards print a label line above each name
+		if i+1 < len(lines) && isPersonName(lines[i+1].text) {
+			switch {
+			case panFatherLabel.MatchString(l.text):
+				setRuleValue(values, "fatherName", lines[i+1].text, 0.95*lines[i+1].confidence)
+			case panNameLabel.MatchString(strings.TrimSpace(l.text)):
+				setRuleValue(values, "fullName", lines[i+1].text, 0.95*lines[i+1].confidence)
+			}
+		}
+	}
+
+	// old cards print the name and the father's name without labels, right above the date of birth
+	if dobLine > 0 {
+		var names []ruleLine
+		for i := dobLine - 1; i >= 0 && len(names) < 2; i-- {
+			if isHeaderLine(lines[i].text) {
+				break
+			}
+			if isPersonName(lines[i].text) {
+				names = append([]ruleLine{lines[i]}, names...)
+			}
+		}
+		if len(names) == 2 {
+			setRuleValue(values, "fullName", names[0].text, 0.85*names[0].confidence)
+			setRuleValue(values, "fatherName", names[1].text, 0.85*names[1].confidence)
+		}
+	}
+
+	return values
+}
+
+func aadhaarRules(doc *ocrDocument) map[string]ruleValue {
+	values := map[string]ruleValue{}
+	lines := ruleLines(doc)
+
+	dobLine := -1
+	for i, l := range lines {
+		if !vidPattern.MatchString(l.text) {
+			if m := aadhaarPattern.FindStringSubmatch(l.text); m != nil {
+				number := m[2] + m[3] + m[4]
+				conf := l.confidence
+				// the last digit is a verhoeff checksum, a number failing it was misread
+				if !verhoeffValid(number) {
+					conf *= 0.5
+				}
+				setRuleValue(values, "docNumber", number, conf)
+			}
+		}
+
+		if m := dobLabelPattern.FindStringSubmatch(l.all); m != nil {
+			dobLine = i
+			setRuleValue(values, "dateOfBirth", m[2], l.confidence)
+		} else if m := yobPattern.FindStringSubmatch(l.all); m != nil {
+			dobLine = i
+			setRuleValue(values, "dateOfBirth", m[2], 0.9*l.confidence)
+		}
+
+		if m := genderPattern.FindStringSubmatch(l.all); m != nil {
+			gender := strings.ToUpper(m[1])
+			switch m[2] {
+			case "पुरुष":
+				gender = "MALE"
+			case "महिला":
+				gender = "FEMALE"
+			}
+			setRuleValue(values, "gender", gender, l.confidence)
+		}
+	}
+
+	// the name is printed right above the date of birth, next to its native script rendering, or on the
+	// same line when the engine merged them
+	if dobLine >= 0 {
+		if loc := dobLabelStart.FindStringIndex(lines[dobLine].all); loc != nil {
+			var latin []string
+			for _, w := range strings.Fields(lines[dobLine].all[:loc[0]]) {
+				if !isNativeScript(w) {
+					latin = append(latin, w)
+				}
+			}
+			prefix := strings.TrimRight(strings.Join(latin, " "), " /:-")
+			if isPersonName(prefix) {
+				setRuleValue(values, "fullName", prefix, 0.85*lines[dobLine].confidence)
+			}
+		}
+	}
+	if dobLine > 0 {
+		for i := dobLine - 1; i >= 0 && i >= dobLine-2; i-- {
+			if isHeaderLine(lines[i].text) {
+				break
+			}
+			if isPersonName(lines[i].text) {
+				setRuleValue(values, "fullName", lines[i].text, 0.85*lines[i].confidence)
+				break
+			}
+		}
+	}
+
+	return values
+}
+
+func setRuleValue(values map[string]ruleValue, field string, value string, confidence float64) {
+	if cur, ok := values[field]; ok && cur.Confidence >= confidence {
+		return
+	}
+	values[field] = ruleValue{Value: value, Confidence: confidence}
+}
+
+// fixPAN checks the token against the PAN format of five letters, four digits and a letter, correcting
+// the letters and digits ocr commonly confuses. It returns whether any character had to be corrected.
+func fixPAN(token string) (string, bool, bool) {
+	token = strings.ToUpper(strings.Trim(token, ".,:;"))
+	if len(token) != 10 {
+		return "", false, false
+	}
+
+	toDigit := map[byte]byte{'O': '0', 'D': '0', 'I': '1', 'L': '1', 'Z': '2', 'S': '5', 'B': '8', 'G': '6'}
+	toLetter := map[byte]byte{'0': 'O', '1': 'I', '2': 'Z', '5': 'S', '8': 'B', '6': 'G'}
+
+	b := []byte(token)
+	fixed := false
+	for i := range b {
+		wantDigit := i >= 5 && i <= 8
+		isDigit := b[i] >= '0' && b[i] <= '9'
+		isLetter := b[i] >= 'A' && b[i] <= 'Z'
+		switch {
+		case wantDigit && isDigit, !wantDigit && isLetter:
+			continue
+		case wantDigit:
+			d, ok := toDigit[b[i]]
+			if !ok {
+				return "", false, false
+			}
+			b[i], fixed = d, true
+		default:
+			l, ok := toLetter[b[i]]
+			if !ok {
+				return "", false, false
+			}
+			b[i], fixed = l, true
+		}
+	}
+
+	// the fourth letter is the holder type, P for a person, C company, H hindu undivided family and so on
+	if !strings.ContainsRune("PCHFATBLJG", rune(b[3])) {
+		return "", false, false
+	}
+	return string(b), fixed, true
+}
+
+func validDate(day, month, year string) bool {
+	d, err1 := strconv.Atoi(day)
+	m, err2 := strconv.Atoi(month)
+	y, err3 := strconv.Atoi(year)
+	return err1 == nil && err2 == nil && err3 == nil && d >= 1 && d <= 31 && m >= 1 && m <= 12 && y >= 1900 && y <= 2100
+}
+
+func isPersonName(s string) bool {
+	if !personNamePattern.MatchString(s) || fieldLabelPattern.MatchString(s) || isHeaderLine(s) {
+		return false
+	}
+	words := strings.Fields(s)
+	return len(words) >= 1 && len(words) <= 5
+}
+
+func isHeaderLine(s string) bool {
+	n := strings.ToLower(strings.Join(strings.FieldsFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == ' ')
+	}), ""))
+	n = strings.Join(strings.Fields(n), " ")
+	for _, h := range headerLines {
+		if strings.Contains(n, h) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	verhoeffD = [10][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+		{2, 3, 4, 0, 1, 7, 8, 9, 5, 6},
+		{3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+		{4, 0, 1, 2, 3, 9, 5, 6, 7, 8},
+		{5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+		{6, 5, 9, 8, 7, 1, 0, 4, 3, 2},
+		{7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+		{8, 7, 6, 5, 9, 3, 2, 1, 0, 4},
+		{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+	}
+	verhoeffP = [8][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+		{5, 8, 0, 3, 7, 9, 6, 1, 4, 2},
+		{8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+		{9, 4, 5, 3, 1, 2, 6, 8, 7, 0},
+		{4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+		{2, 7, 9, 3, 8, 0, 6, 4, 1, 5},
+		{7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+	}
+)
+
+// verhoeffValid checks the verhoeff checksum digit that ends every aadhaar number.
+func verhoeffValid(number string) bool {
+	c := 0
+	for i := 0; i < len(number); i++ {
+		d := number[len(number)-1-i]
+		if d < '0' || d > '9' {
+			return false
+		}
+		c = verhoeffD[c][verhoeffP[i%8][d-'0']]
+	}
+	return c == 0
+}
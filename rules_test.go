@@ -0,0 +1,215 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ruleDoc lays the rows out one under the other, every word read with the given confidence.
+func ruleDoc(confidence float64, rows ...string) *ocrDocument {
+	var lines []ocrLine
+	for i, row := range rows {
+		top, bottom := float64(i*20), float64(i*20+16)
+		line := ocrLine{Page: 1, Polygon: []float64{0, top, 500, top, 500, bottom, 0, bottom}}
+		for _, w := range strings.Fields(row) {
+			line.Words = append(line.Words, ocrWord{Content: w, Confidence: confidence, Page: 1})
+		}
+		lines = append(lines, line)
+	}
+	return newOCRDocument(engineAzure, lines)
+}
+
+func ruleValues(values map[string]ruleValue) map[string]string {
+	out := map[string]string{}
+	for k, v := range values {
+		out[k] = v.Value
+	}
+	return out
+}
+
+func TestExtractWithRulesPAN(t *testing.T) {
+	tests := []struct {
+		name string
+		rows []string
+		want map[string]string
+	}{
+		{
+			name: "old card",
+			rows: []string{
+				"INCOME TAX DEPARTMENT",
+				"GOVT. OF INDIA",
+				"RAHUL KUMAR SHARMA",
+				"SURESH KUMAR SHARMA",
+				"15/08/1990",
+				"Permanent Account Number",
+				"ABCPS1234D",
+				"Signature",
+			},
+			want: map[string]string{
+				"fullName":    "RAHUL KUMAR SHARMA",
+				"fatherName":  "SURESH KUMAR SHARMA",
+				"dateOfBirth": "15/08/1990",
+				"docNumber":   "ABCPS1234D",
+			},
+		},
+		{
+			name: "new card with labels",
+			rows: []string{
+				"INCOME TAX DEPARTMENT",
+				"Permanent Account Number Card",
+				"BQRPM4821K",
+				"नाम / Name",
+				"PRIYA ANAND MEHTA",
+				"पिता का नाम / Father's Name",
+				"ANAND KRISHNA MEHTA",
+				"जन्म की तारीख / Date of Birth",
+				"22/11/1987",
+			},
+			want: map[string]string{
+				"fullName":    "PRIYA ANAND MEHTA",
+				"fatherName":  "ANAND KRISHNA MEHTA",
+				"dateOfBirth": "22/11/1987",
+				"docNumber":   "BQRPM4821K",
+			},
+		},
+		{
+			name: "issue date",
+			rows: []string{
+				"RAHUL KUMAR SHARMA",
+				"SURESH KUMAR SHARMA",
+				"15/08/1990",
+				"ABCPS1234D",
+				"10052008",
+			},
+			want: map[string]string{
+				"fullName":    "RAHUL KUMAR SHARMA",
+				"fatherName":  "SURESH KUMAR SHARMA",
+				"dateOfBirth": "15/08/1990",
+				"docNumber":   "ABCPS1234D",
+				"issueDate":   "10/05/2008",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got := ruleValues(extractWithRules([]*ocrDocument{ruleDoc(0.99, tt.rows...)}, panDoc))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractWithRulesAadhaar(t *testing.T) {
+	doc := ruleDoc(0.99,
+		"भारत सरकार",
+		"GOVERNMENT OF INDIA",
+		"PRIYA MEHTA",
+		"जन्म तिथि / DOB: 22/11/1987",
+		"महिला / FEMALE",
+		"4987 1234 5679",
+	)
+	values := extractWithRules([]*ocrDocument{doc}, aadharDoc)
+	want := map[string]string{
+		"fullName":    "PRIYA MEHTA",
+		"dateOfBirth": "22/11/1987",
+		"gender":      "FEMALE",
+		"docNumber":   "498712345679",
+	}
+	if got := ruleValues(values); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !rulesComplete(values, aadharDoc) {
+		t.Errorf("rules are not complete: %v", values)
+	}
+}
+
+func TestExtractWithRulesAadhaarChecksum(t *testing.T) {
+	// the last digit is misread, the number is kept but left to the llm
+	values := extractWithRules([]*ocrDocument{ruleDoc(0.99, "4987 1234 5678")}, aadharDoc)
+	v, ok := values["docNumber"]
+	if !ok || v.Value != "498712345678" {
+		t.Fatalf("got %v, want 498712345678", v)
+	}
+	if v.Confidence >= minRuleConfidence {
+		t.Errorf("got confidence %v for a number failing the checksum", v.Confidence)
+	}
+
+	// a virtual id has 16 digits and is not an aadhaar number
+	if v, ok := extractWithRules([]*ocrDocument{ruleDoc(0.99, "VID : 9134 5678 9012 3456")}, aadharDoc)["docNumber"]; ok {
+		t.Errorf("got docNumber %v from a virtual id", v.Value)
+	}
+}
+
+func TestExtractWithRulesKeepsMostConfidentSource(t *testing.T) {
+	docs := []*ocrDocument{
+		ruleDoc(0.6, "ABCPS1234D"),
+		ruleDoc(0.95, "ABCPS1234D"),
+	}
+	v := extractWithRules(docs, panDoc)["docNumber"]
+	if v.Source != 1 || v.Confidence != 0.95 {
+		t.Errorf("got %+v, want the value of the second source", v)
+	}
+}
+
+func TestVerhoeffValid(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"2363", true},
+		{"2364", false},
+		{"498712345679", true},
+		{"498712345678", false},
+		// swapping adjacent digits is caught as well
+		{"489712345679", false},
+		{"4987 1234 5679", false},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if got := verhoeffValid(tt.number); got != tt.want {
+			t.Errorf("verhoeffValid(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestFixPAN(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+		fixed bool
+		ok    bool
+	}{
+		{"ABCPS1234D", "ABCPS1234D", false, true},
+		{"abcps1234d.", "ABCPS1234D", false, true},
+		// digits read as letters and letters read as digits
+		{"ABCPSI2O4D", "ABCPS1204D", true, true},
+		{"A8CPS1234D", "ABCPS1234D", true, true},
+		// the fourth letter is not a holder type
+		{"ABCXS1234D", "", false, false},
+		// a 7 is never misread for a letter
+		{"ABCPS12347", "", false, false},
+		{"ABCPS123D", "", false, false},
+	}
+	for _, tt := range tests {
+		got, fixed, ok := fixPAN(tt.token)
+		if got != tt.want || fixed != tt.fixed || ok != tt.ok {
+			t.Errorf("fixPAN(%q) = %q, %v, %v, want %q, %v, %v", tt.token, got, fixed, ok, tt.want, tt.fixed, tt.ok)
+		}
+	}
+}
+
+func TestRuleGaps(t *testing.T) {
+	values := map[string]ruleValue{
+		"fullName":    {Value: "RAHUL KUMAR SHARMA", Confidence: 0.9},
+		"dateOfBirth": {Value: "15/08/1990", Confidence: 0.99},
+		"docNumber":   {Value: "ABCPS1234D", Confidence: 0.7},
+	}
+	want := []string{"fatherName", "docNumber", "issueDate"}
+	if got := ruleGaps(values, panDoc); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	scriptLatin      = "Latin"
+	scriptDevanagari = "Devanagari"
+	scriptBengali    = "Bengali"
+	scriptGurmukhi   = "Gurmukhi"
+	scriptGujarati   = "Gujarati"
+	scriptOriya      = "Oriya"
+	scriptTamil      = "Tamil"
+	scriptTelugu     = "Telugu"
+	scriptKannada    = "Kannada"
+	scriptMalayalam  = "Malayalam"
+	// digits, punctuation and symbols shared by all scripts
+	scriptCommon = "Common"
+
+	// longest native name looked for next to the english one
+	maxNativeNameWords = 4
+)
+
+var indicScripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{scriptDevanagari, unicode.Devanagari},
+	{scriptBengali, unicode.Bengali},
+	{scriptGurmukhi, unicode.Gurmukhi},
+	{scriptGujarati, unicode.Gujarati},
+	{scriptOriya, unicode.Oriya},
+	{scriptTamil, unicode.Tamil},
+	{scriptTelugu, unicode.Telugu},
+	{scriptKannada, unicode.Kannada},
+	{scriptMalayalam, unicode.Malayalam},
+}
+
+// nameFields are the fields printed both in the regional script and in english.
+var nameFields = []string{"fullName", "fatherName", "name"}
+
+// native script words printed as labels next to the name, never part of it
+var nativeLabels = map[string]bool{
+	"नाम": true, "पिता": true, "का": true, "जन्म": true, "तिथि": true, "पुरुष": true, "महिला": true,
+	"भारत": true, "सरकार": true, "आयकर": true, "विभाग": true, "आधार": true, "मेरा": true, "मेरी": true, "पहचान": true,
+}
+
+type languageSummary struct {
+	Locale     string  `json:"locale"`
+	Script     string  `json:"script"`
+	Share      float64 `json:"share"`
+	Confidence float64 `json:"confidence"`
+}
+
+type nativeName struct {
+	Value  string `json:"value"`
+	Script string `json:"script"`
+	Locale string `json:"locale,omitempty"`
+	// Transliterated is Value romanized, MatchScore its similarity with the english name
+	Transliterated string  `json:"transliterated,omitempty"`
+	MatchScore     float64 `json:"matchScore"`
+}
+
+func scriptOf(r rune) string {
+	if unicode.Is(unicode.Latin, r) {
+		return scriptLatin
+	}
+	for _, s := range indicScripts {
+		if unicode.Is(s.table, r) {
+			return s.name
+		}
+	}
+	return scriptCommon
+}
+
+// dominantScript returns the script most letters of the text are written in, Common when it has none.
+func dominantScript(s string) string {
+	counts := map[string]int{}
+	for _, r := range s {
+		if script := scriptOf(r); script != scriptCommon {
+			counts[script]++
+		}
+	}
+
+	best, n := scriptCommon, 0
+	for script, c := range counts {
+		if c > n || (c == n && script < best) {
+			best, n = script, c
+		}
+	}
+	return best
+}
+
+func isNativeScript(s string) bool {
+	script := dominantScript(s)
+	return script != scriptLatin && script != scriptCommon
+}
+
+// summarizeLanguages turns the azure language spans into the share of content per locale.
+func summarizeLanguages(result *AnalyzeResult) []languageSummary {
+	if result == nil {
+		return nil
+	}
+	total := 0
+	for _, p := range result.Pages {
+		for _, s := range p.Spans {
+			total += s.Length
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	runes := []rune(result.Content)
+	var summaries []languageSummary
+	for _, l := range result.Languages {
+		length := 0
+		var sb strings.Builder
+		for _, s := range l.Spans {
+			length += s.Length
+			// text elements and runes only differ for combined characters, close enough to pick the script
+			if s.Offset < len(runes) {
+				end := s.Offset + s.Length
+				if end > len(runes) {
+					end = len(runes)
+				}
+				sb.WriteString(string(runes[s.Offset:end]))
+			}
+		}
+		summaries = append(summaries, languageSummary{
+			Locale:     l.Locale,
+			Script:     dominantScript(sb.String()),
+			Share:      math.Round(float64(length)/float64(total)*100) / 100,
+			Confidence: l.Confidence,
+		})
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return summaries[i].Share > summaries[j].Share
+	})
+	return summaries
+}
+
+// localeAt returns the locale azure detected for the span, empty when none covers it.
+func localeAt(result *AnalyzeResult, offset int, length int) string {
+	if result == nil {
+		return ""
+	}
+	for _, l := range result.Languages {
+		if inSpans(offset, length, l.Spans) {
+			return l.Locale
+		}
+	}
+	return ""
+}
+
+// mergeNativeText replaces whatever an engine that only reads latin script made of native script text
+// with the words azure read there. Native lines it missed entirely are added and put in reading order.
+func mergeNativeText(doc *ocrDocument, azureDoc *ocrDocument) *ocrDocument {
+	type nativeWord struct {
+		word ocrWord
+		box  []float64
+		line int
+		used bool
+	}
+
+	var native []*nativeWord
+	for i, l := range azureDoc.Lines {
+		for _, w := range l.Words {
+			if isNativeScript(w.Content) {
+				native = append(native, &nativeWord{word: w, box: boundingPolygon(w.Polygon), line: i})
+			}
+		}
+	}
+	if len(native) == 0 {
+		return doc
+	}
+
+	lines := make([]ocrLine, 0, len(doc.Lines))
+	for _, l := range doc.Lines {
+		merged := ocrLine{Page: l.Page, Polygon: l.Polygon}
+		for _, w := range l.Words {
+			box := boundingPolygon(w.Polygon)
+			replaced := false
+			for _, n := range native {
+				if overlapRatio(box, n.box) > 0.5 {
+					replaced = true
+					if !n.used {
+						n.used = true
+						merged.Words = append(merged.Words, n.word)
+					}
+				}
+			}
+			if !replaced {
+				merged.Words = append(merged.Words, w)
+			}
+		}
+		lines = append(lines, merged)
+	}
+
+	// native text the other engine did not pick up at all, kept on the azure line it was read on
+	missed := map[int]*ocrLine{}
+	for _, n := range native {
+		if n.used {
+			continue
+		}
+		l, ok := missed[n.line]
+		if !ok {
+			l = &ocrLine{Page: n.word.Page}
+			missed[n.line] = l
+		}
+		l.Words = append(l.Words, n.word)
+		l.Polygon = boundingPolygon(l.Polygon, n.word.Polygon)
+	}
+	for i := range azureDoc.Lines {
+		if l, ok := missed[i]; ok {
+			lines = append(lines, *l)
+		}
+	}
+
+	return newOCRDocument(doc.Engine, lines)
+}
+
+// findNativeNames looks for the native script rendering of every english name field. Indian ids print it
+// right before the english name, or right after it on some regional cards.
+func findNativeNames(fields map[string]interface{}, azureDoc *ocrDocument, result *AnalyzeResult) map[string]*nativeName {
+	names := map[string]*nativeName{}
+	for _, field := range nameFields {
+		v, ok := fields[field].(string)
+		if !ok || isMissingValue(v) {
+			continue
+		}
+		runs := matchRuns(v, azureDoc)
+		if len(runs) == 0 {
+			continue
+		}
+
+		words := nativeWordsBefore(azureDoc.Words, runs[0].Start)
+		if len(words) == 0 {
+			words = nativeWordsAfter(azureDoc.Words, runs[0].End)
+		}
+		if len(words) == 0 {
+			continue
+		}
+
+		parts := make([]string, 0, len(words))
+		for _, w := range words {
+			parts = append(parts, w.Content)
+		}
+		value := strings.Join(parts, " ")
+		names[field] = &nativeName{
+			Value:  value,
+			Script: dominantScript(value),
+			Locale: localeAt(result, words[0].Offset, words[0].Length),
+		}
+	}
+	return names
+}
+
+func nativeWordsBefore(words []ocrWord, start int) []ocrWord {
+	i := start
+	for i > 0 && start-i < maxNativeNameWords {
+		w := words[i-1]
+		if !isNativeScript(w.Content) || nativeLabels[normalizeForMatch(w.Content)] {
+			break
+		}
+		i--
+	}
+	return words[i:start]
+}
+
+func nativeWordsAfter(words []ocrWord, end int) []ocrWord {
+	i := end + 1
+	for i < len(words) && i-end-1 < maxNativeNameWords {
+		w := words[i]
+		if !isNativeScript(w.Content) || nativeLabels[normalizeForMatch(w.Content)] {
+			break
+		}
+		i++
+	}
+	return words[end+1 : i]
+}
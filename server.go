@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Bureau-Inc/overwatch-common/logger"
+	"github.com/Bureau-Inc/overwatch-common/logger/tag"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	defaultServeAddr       = ":8080"
+	defaultShutdownTimeout = 30 * time.Second
+	maxRequestBody         = 10 << 20
+)
+
+// runServe serves the api over http for containers and local runs, answering every path but the health
+// checks with HandleRequest as api gateway would. It stops on SIGINT or SIGTERM, turning unready first and
+// letting the requests in flight finish.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", defaultServeAddr, "address to listen on, PORT overrides the port")
+	shutdownTimeout := fs.Duration("shutdown-timeout", defaultShutdownTimeout, "time given to requests in flight on shutdown")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		*addr = ":" + port
+	}
+	trustTenantHeader = true
+
+	var ready atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHTTPResp(w, buildJSONResp(http.StatusOK, map[string]interface{}{"status": "ok"}))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			writeHTTPResp(w, buildJSONResp(http.StatusServiceUnavailable, map[string]interface{}{"status": "not ready"}))
+			return
+		}
+		writeHTTPResp(w, buildJSONResp(http.StatusOK, map[string]interface{}{"status": "ready"}))
+	})
+	mux.HandleFunc("/", serveAPI)
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		logger.ERROR("failed to listen", tag.NewStringTag("addr", *addr), tag.NewErrorTag(err))
+		return 1
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+	ready.Store(true)
+	logger.INFO("serving", tag.NewStringTag("addr", ln.Addr().String()))
+
+	select {
+	case err := <-errs:
+		logger.ERROR("failed to serve", tag.NewErrorTag(err))
+		return 1
+	case <-ctx.Done():
+	}
+
+	ready.Store(false)
+	logger.INFO("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.ERROR("failed to shut down gracefully", tag.NewErrorTag(err))
+		return 1
+	}
+	return 0
+}
+
+// serveAPI turns the http request into the api gateway event HandleRequest expects, and its response back.
+func serveAPI(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeHTTPResp(w, buildJSONResp(http.StatusRequestEntityTooLarge, map[string]interface{}{"error": "request body too large"}))
+			return
+		}
+		writeHTTPResp(w, buildErrorResp(fmt.Errorf("failed to read request body: %v", err)))
+		return
+	}
+
+	req := events.APIGatewayProxyRequest{
+		HTTPMethod:                      r.Method,
+		Path:                            r.URL.Path,
+		Headers:                         map[string]string{},
+		MultiValueHeaders:               map[string][]string{},
+		QueryStringParameters:           map[string]string{},
+		MultiValueQueryStringParameters: map[string][]string{},
+		Body:                            string(body),
+	}
+	for k, v := range r.Header {
+		req.Headers[k] = v[0]
+		req.MultiValueHeaders[k] = v
+	}
+	for k, v := range r.URL.Query() {
+		req.QueryStringParameters[k] = v[0]
+		req.MultiValueQueryStringParameters[k] = v
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.RequestContext.Identity.SourceIP = host
+	}
+
+	start := time.Now()
+	resp, err := HandleRequest(req)
+	if err != nil {
+		resp = buildErrorResp(err)
+	}
+	logger.INFO("served request", tag.NewStringTag("method", r.Method), tag.NewStringTag("path", r.URL.Path),
+		tag.NewAnyTag("status", resp.StatusCode), tag.NewAnyTag("durationMs", time.Since(start).Milliseconds()))
+	writeHTTPResp(w, resp)
+}
+
+func writeHTTPResp(w http.ResponseWriter, resp events.APIGatewayProxyResponse) {
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	for k, vs := range resp.MultiValueHeaders {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+
+	body := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(resp.Body)
+		if err != nil {
+			logger.ERROR("failed to decode response body", tag.NewErrorTag(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body = b
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	engineTesseract = "tesseract"
+
+	defaultTesseractPath  = "tesseract"
+	defaultTesseractLangs = "eng+hin"
+	// a run taking longer is killed and counted as a failure of the engine, so that the fallback runs
+	defaultTesseractTimeout = 30 * time.Second
+
+	// tsv levels, 4 is a text line and 5 a word
+	tesseractLineLevel = 4
+	tesseractWordLevel = 5
+)
+
+// fetchOCRAnalysisResultfromTesseract runs the tesseract cli on the image and returns its tsv output.
+// TESSERACT_PATH and TESSERACT_LANGS change the binary and the language packs used, TESSERACT_TIMEOUT the
+// time it is given.
+func fetchOCRAnalysisResultfromTesseract(image []byte) (string, error) {
+	path := os.Getenv("TESSERACT_PATH")
+	if path == "" {
+		path = defaultTesseractPath
+	}
+	langs := os.Getenv("TESSERACT_LANGS")
+	if langs == "" {
+		langs = defaultTesseractLangs
+	}
+
+	timeout := defaultTesseractTimeout
+	if d, err := time.ParseDuration(os.Getenv("TESSERACT_TIMEOUT")); err == nil && d > 0 {
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, "stdin", "stdout", "-l", langs, "tsv")
+	cmd.Stdin = bytes.NewReader(image)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("tesseract did not finish within %s", timeout)
+		}
+		return "", fmt.Errorf("failed to run tesseract: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// normalizeTesseractTSV builds the document from the tsv rows, whose columns are level, page_num,
+// block_num, par_num, line_num, word_num, left, top, width, height, conf and text.
+func normalizeTesseractTSV(tsv string, img *preparedImage) *ocrDocument {
+	var lines []ocrLine
+	lineIndex := map[string]int{}
+
+	rows := strings.Split(tsv, "\n")
+	for i, row := range rows {
+		// first row is the header
+		if i == 0 || strings.TrimSpace(row) == "" {
+			continue
+		}
+		cols := strings.SplitN(row, "\t", 12)
+		if len(cols) < 11 {
+			continue
+		}
+
+		var nums [11]float64
+		valid := true
+		for c := 0; c < 11; c++ {
+			v, err := strconv.ParseFloat(strings.TrimSpace(cols[c]), 64)
+			if err != nil {
+				valid = false
+				break
+			}
+			nums[c] = v
+		}
+		if !valid {
+			continue
+		}
+
+		level, page := int(nums[0]), int(nums[1])
+		left, top, width, height := nums[6], nums[7], nums[8], nums[9]
+		polygon := img.sourcePolygon([]float64{left, top, left + width, top, left + width, top + height, left, top + height})
+		key := strings.Join(cols[1:5], "/")
+
+		switch level {
+		case tesseractLineLevel:
+			lineIndex[key] = len(lines)
+			lines = append(lines, ocrLine{Page: page, Polygon: polygon})
+		case tesseractWordLevel:
+			text := ""
+			if len(cols) > 11 {
+				text = strings.TrimSpace(cols[11])
+			}
+			if text == "" {
+				continue
+			}
+			// -1 is given when tesseract has no confidence for the word
+			w := ocrWord{
+				Content:    text,
+				Confidence: math.Max(nums[10], 0) / 100,
+				Page:       page,
+				Polygon:    polygon,
+				Offset:     i,
+				Length:     len(text),
+			}
+			idx, ok := lineIndex[key]
+			if !ok {
+				idx = len(lines)
+				lineIndex[key] = idx
+				lines = append(lines, ocrLine{Page: page, Polygon: polygon})
+			}
+			lines[idx].Words = append(lines[idx].Words, w)
+		}
+	}
+
+	return newOCRDocument(engineTesseract, lines)
+}
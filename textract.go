@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/textract"
+)
+
+const (
+	engineTextract = "textract"
+
+	textractAnalyzeID          = "AnalyzeID"
+	textractDetectDocumentText = "DetectDocumentText"
+)
+
+// awsEngineFor returns the aws ocr engine to compare azure against, AWS_OCR_ENGINE sets the default.
+// Rekognition reads scene text and stops at 100 words, textract reads dense documents in full.
+func awsEngineFor(override string) (string, error) {
+	engine := strings.ToLower(override)
+	if engine == "" {
+		engine = strings.ToLower(os.Getenv("AWS_OCR_ENGINE"))
+	}
+
+	switch engine {
+	case "", engineRekognition:
+		return engineRekognition, nil
+	case engineTextract:
+		return engineTextract, nil
+	}
+	return "", fmt.Errorf("unsupported aws ocr engine: %s", override)
+}
+
+// textractAPIFor returns AnalyzeID for identity documents, whose blocks are tuned for id cards, and
+// DetectDocumentText for everything else.
+func textractAPIFor(docType string) string {
+	if docType == panDoc || docType == aadharDoc {
+		return textractAnalyzeID
+	}
+	return textractDetectDocumentText
+}
+
+// fetchOCRAnalysisResultfromTextract calls the textract api chosen for the doc type.
+func fetchOCRAnalysisResultfromTextract(image []byte, docType string) ([]*textract.Block, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String("ap-south-1"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	svc := textract.New(sess)
+
+	if textractAPIFor(docType) == textractAnalyzeID {
+		out, err := svc.AnalyzeID(&textract.AnalyzeIDInput{
+			DocumentPages: []*textract.Document{{Bytes: image}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to call AWS textract AnalyzeID: %v", err)
+		}
+
+		var blocks []*textract.Block
+		for _, d := range out.IdentityDocuments {
+			blocks = append(blocks, d.Blocks...)
+		}
+		return blocks, nil
+	}
+
+	out, err := svc.DetectDocumentText(&textract.DetectDocumentTextInput{
+		Document: &textract.Document{Bytes: image},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to call AWS textract DetectDocumentText: %v", err)
+	}
+	return out.Blocks, nil
+}
+
+// normalizeTextractBlocks groups the WORD blocks under the LINE blocks that list them as children, the
+// same way rekognition detections are grouped through ParentId.
+func normalizeTextractBlocks(blocks []*textract.Block, img *preparedImage) *ocrDocument {
+	width, height := img.size()
+	polygonOf := func(b *textract.Block) []float64 {
+		var polygon []float64
+		if b.Geometry != nil {
+			for _, p := range b.Geometry.Polygon {
+				polygon = append(polygon, aws.Float64Value(p.X)*width, aws.Float64Value(p.Y)*height)
+			}
+		}
+		return img.sourcePolygon(polygon)
+	}
+	pageOf := func(b *textract.Block) int {
+		if b.Page == nil {
+			return 1
+		}
+		return int(aws.Int64Value(b.Page))
+	}
+
+	words := map[string]ocrWord{}
+	for i, b := range blocks {
+		if aws.StringValue(b.BlockType) != textract.BlockTypeWord {
+			continue
+		}
+		content := aws.StringValue(b.Text)
+		words[aws.StringValue(b.Id)] = ocrWord{
+			Content:     content,
+			Confidence:  aws.Float64Value(b.Confidence) / 100,
+			Page:        pageOf(b),
+			Polygon:     polygonOf(b),
+			Offset:      i,
+			Length:      len(content),
+			Handwritten: aws.StringValue(b.TextType) == textract.TextTypeHandwriting,
+		}
+	}
+
+	var lines []ocrLine
+	for _, b := range blocks {
+		if aws.StringValue(b.BlockType) != textract.BlockTypeLine {
+			continue
+		}
+		line := ocrLine{Page: pageOf(b), Polygon: polygonOf(b)}
+		for _, r := range b.Relationships {
+			if aws.StringValue(r.Type) != textract.RelationshipTypeChild {
+				continue
+			}
+			for _, id := range r.Ids {
+				if w, ok := words[aws.StringValue(id)]; ok {
+					line.Words = append(line.Words, w)
+				}
+			}
+		}
+		if len(line.Words) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	return newOCRDocument(engineTextract, lines)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+const (
+	// native and english names at least this similar confirm each other
+	nameMatchConfirm = 0.85
+	// below this they disagree and one of the two readings is likely wrong
+	nameMatchConflict = 0.6
+)
+
+// The brahmic unicode blocks share the ISCII layout, so the same offset from the block start is the same
+// letter in every script and one table covers all of them. Tamil leaves many of the slots unused.
+var indicBlockStart = map[string]rune{
+	scriptDevanagari: 0x0900,
+	scriptBengali:    0x0980,
+	scriptGurmukhi:   0x0A00,
+	scriptGujarati:   0x0A80,
+	scriptOriya:      0x0B00,
+	scriptTamil:      0x0B80,
+	scriptTelugu:     0x0C00,
+	scriptKannada:    0x0C80,
+	scriptMalayalam:  0x0D00,
+}
+
+const (
+	indicVirama = 0x4D
+	indicNukta  = 0x3C
+)
+
+var indicVowels = map[rune]string{
+	0x05: "a", 0x06: "aa", 0x07: "i", 0x08: "ii", 0x09: "u", 0x0A: "uu", 0x0B: "ri",
+	0x0D: "e", 0x0E: "e", 0x0F: "e", 0x10: "ai", 0x11: "o", 0x12: "o", 0x13: "o", 0x14: "au",
+}
+
+var indicConsonants = map[rune]string{
+	0x15: "k", 0x16: "kh", 0x17: "g", 0x18: "gh", 0x19: "ng",
+	0x1A: "ch", 0x1B: "chh", 0x1C: "j", 0x1D: "jh", 0x1E: "ny",
+	0x1F: "t", 0x20: "th", 0x21: "d", 0x22: "dh", 0x23: "n",
+	0x24: "t", 0x25: "th", 0x26: "d", 0x27: "dh", 0x28: "n", 0x29: "n",
+	0x2A: "p", 0x2B: "ph", 0x2C: "b", 0x2D: "bh", 0x2E: "m",
+	0x2F: "y", 0x30: "r", 0x31: "r", 0x32: "l", 0x33: "l", 0x34: "l", 0x35: "v",
+	0x36: "sh", 0x37: "sh", 0x38: "s", 0x39: "h",
+}
+
+var indicVowelSigns = map[rune]string{
+	0x3E: "aa", 0x3F: "i", 0x40: "ii", 0x41: "u", 0x42: "uu", 0x43: "ri",
+	0x45: "e", 0x46: "e", 0x47: "e", 0x48: "ai", 0x49: "o", 0x4A: "o", 0x4B: "o", 0x4C: "au",
+}
+
+var indicMarks = map[rune]string{
+	0x01: "n", 0x02: "n", 0x03: "h",
+}
+
+// phoneticRules fold spellings that romanized indian names use interchangeably, applied in order.
+var phoneticRules = strings.NewReplacer(
+	"chh", "ch", "aa", "a", "ee", "i", "ii", "i", "oo", "u", "uu", "u",
+	"kh", "k", "gh", "g", "jh", "j", "th", "t", "dh", "d", "ph", "f", "bh", "b", "sh", "s",
+	"w", "v", "z", "j", "q", "k", "ck", "k", "x", "ks",
+)
+
+// transliterate romanizes text written in any of the brahmic scripts, other characters are kept as is.
+func transliterate(s string) string {
+	var sb strings.Builder
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		offset, ok := indicOffset(r)
+		if !ok {
+			sb.WriteRune(r)
+			continue
+		}
+
+		if c, ok := indicConsonants[offset]; ok {
+			sb.WriteString(c)
+
+			next := i + 1
+			if next < len(runes) {
+				if o, ok := indicOffset(runes[next]); ok && o == indicNukta {
+					next++
+				}
+			}
+			if next < len(runes) {
+				if o, ok := indicOffset(runes[next]); ok {
+					if sign, ok := indicVowelSigns[o]; ok {
+						sb.WriteString(sign)
+						i = next
+						continue
+					}
+					if o == indicVirama {
+						i = next
+						continue
+					}
+				}
+			}
+			// the inherent vowel is not pronounced at the end of a word, गौरव is gaurav
+			if next < len(runes) && isIndicLetter(runes[next]) {
+				sb.WriteString("a")
+			}
+			i = next - 1
+			continue
+		}
+
+		if v, ok := indicVowels[offset]; ok {
+			sb.WriteString(v)
+		} else if m, ok := indicMarks[offset]; ok {
+			sb.WriteString(m)
+		} else if offset >= 0x66 && offset <= 0x6F {
+			sb.WriteRune('0' + (offset - 0x66))
+		}
+	}
+	return sb.String()
+}
+
+func indicOffset(r rune) (rune, bool) {
+	for _, start := range indicBlockStart {
+		if r >= start && r < start+0x80 {
+			return r - start, true
+		}
+	}
+	return 0, false
+}
+
+func isIndicLetter(r rune) bool {
+	offset, ok := indicOffset(r)
+	if !ok {
+		return false
+	}
+	_, consonant := indicConsonants[offset]
+	_, vowel := indicVowels[offset]
+	_, sign := indicVowelSigns[offset]
+	_, mark := indicMarks[offset]
+	return consonant || vowel || sign || mark || offset == indicNukta || offset == indicVirama
+}
+
+// phoneticKey reduces a romanized name to a form where common spelling variants compare equal.
+func phoneticKey(s string) string {
+	key := phoneticRules.Replace(normalizeForMatch(s))
+	if strings.HasSuffix(key, "y") {
+		key = strings.TrimSuffix(key, "y") + "i"
+	}
+
+	// collapse doubled letters, e.g. "jaggannath" and "jagannath"
+	var sb strings.Builder
+	var last rune
+	for _, r := range key {
+		if r != last {
+			sb.WriteRune(r)
+		}
+		last = r
+	}
+	return sb.String()
+}
+
+// nameMatchScore compares a native script name with its english rendering.
+func nameMatchScore(native string, english string) float64 {
+	a, b := phoneticKey(transliterate(native)), phoneticKey(english)
+	if a == "" || b == "" {
+		return 0
+	}
+	return math.Round(similarity(a, b)*100) / 100
+}
+
+// crossCheckNames compares every name field with its native rendering and raises the confidence of the
+// field when both agree, or lowers it when they do not.
+func crossCheckNames(fields map[string]interface{}, details map[string]*fieldDetail) {
+	for field, d := range details {
+		if d.Native == nil {
+			continue
+		}
+		english, ok := fields[field].(string)
+		if !ok {
+			continue
+		}
+
+		d.Native.Transliterated = transliterate(d.Native.Value)
+		d.Native.MatchScore = nameMatchScore(d.Native.Value, english)
+
+		switch {
+		case d.Native.MatchScore >= nameMatchConfirm:
+			d.Confidence += (1 - d.Confidence) / 2
+		case d.Native.MatchScore < nameMatchConflict:
+			d.Confidence *= d.Native.MatchScore / nameMatchConflict
+		}
+		d.Confidence = math.Round(d.Confidence*1000) / 1000
+	}
+}
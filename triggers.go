@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Bureau-Inc/overwatch-common/logger"
+	"github.com/Bureau-Inc/overwatch-common/logger/tag"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// handlerS3 is the HANDLER of the lambda triggered by documents landing in a bucket
+	handlerS3 = "s3"
+
+	// s3ResultSuffix is added to the key of a document for its result, the trigger has to leave these out
+	s3ResultSuffix = ".result.json"
+)
+
+// allowAnyS3Bucket lets fetchImage read the images of any bucket the role of the function can read. Only
+// the s3 trigger, whose events come from the buckets it is subscribed to, and the cli turn it on.
+// Otherwise the caller picks the uri, so only the buckets of S3_ALLOWED_BUCKETS are read.
+var allowAnyS3Bucket bool
+
+func s3BucketAllowed(bucket string) bool {
+	if allowAnyS3Bucket {
+		return true
+	}
+	for _, b := range splitList(os.Getenv("S3_ALLOWED_BUCKETS")) {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// queueMessage is a message of the jobs queue. Other producers can send a payload instead of a job id,
+// it is analysed right away and its result written to the s3 uri in Output when set, which has to be in
+// one of the buckets of S3_ALLOWED_BUCKETS.
+type queueMessage struct {
+	JobID  string `json:"jobId"`
+	Tenant string `json:"tenant"`
+	Output string `json:"output"`
+	batchItem
+}
+
+// processQueueMessage returns an error when the message is worth retrying.
+func processQueueMessage(record events.SQSMessage) error {
+	msg := &queueMessage{}
+	if err := json.Unmarshal([]byte(record.Body), msg); err != nil {
+		return fmt.Errorf("failed to unmarshal message: %v", err)
+	}
+	if msg.JobID != "" {
+		return processJob(msg.JobID)
+	}
+
+	if msg.ID == "" {
+		msg.ID = record.MessageId
+	}
+	if msg.Tenant == "" {
+		msg.Tenant = "unknown"
+	}
+
+	// the output is checked before any paid api is called, a retry would not change the answer
+	var bucket, key string
+	if msg.Output != "" {
+		var err error
+		bucket, key, err = parseS3URI(msg.Output)
+		if err == nil && !s3BucketAllowed(bucket) {
+			err = fmt.Errorf("bucket %s is not allowed", bucket)
+		}
+		if err != nil {
+			logger.ERROR("invalid message output", tag.NewStringTag("messageId", record.MessageId), tag.NewErrorTag(err))
+			return nil
+		}
+	}
+
+	r := processBatchItem(&msg.batchItem, 0, msg.Tenant)
+
+	if msg.Output != "" {
+		b, _ := json.Marshal(r)
+		if err := uploadToS3(bucket, key, b, "application/json"); err != nil {
+			return fmt.Errorf("failed to upload result: %v", err)
+		}
+	}
+
+	if r.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("failed to process message: %s", r.Error)
+	}
+	return nil
+}
+
+// HandleS3Event analyses the documents of a bucket notification and writes the result of each next to
+// it, under its key with .result.json added. The doc type is the folder the document is in, e.g.
+// uploads/pan/card.jpg, or else S3_DOC_TYPE with S3_OUTPUT_FIELDS for unknown documents. The bucket is
+// the tenant. An error makes lambda retry the event.
+func HandleS3Event(event events.S3Event) error {
+	var failed []string
+	for _, record := range event.Records {
+		bucket := record.S3.Bucket.Name
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			key = record.S3.Object.Key
+		}
+		if strings.HasSuffix(key, s3ResultSuffix) {
+			continue
+		}
+
+		input := &payload{
+			DocType:      s3DocTypeOf(key),
+			FrontURL:     fmt.Sprintf("s3://%s/%s", bucket, key),
+			OutputFields: os.Getenv("S3_OUTPUT_FIELDS"),
+		}
+		resp := processPayload(input, bucket)
+
+		if err := uploadToS3(bucket, key+s3ResultSuffix, []byte(resp.Body), "application/json"); err != nil {
+			logger.ERROR("failed to upload result", tag.NewStringTag("key", key), tag.NewErrorTag(err))
+			failed = append(failed, key)
+			continue
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			failed = append(failed, key)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to process documents: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func s3DocTypeOf(key string) string {
+	dir := strings.ToUpper(path.Base(path.Dir(key)))
+	if dir == panDoc || dir == aadharDoc {
+		return dir
+	}
+	return os.Getenv("S3_DOC_TYPE")
+}
@@ -9,8 +9,8 @@ type (
 	}
 
 	BoundingRegion struct {
-		PageNumber int   `json:"pageNumber"`
-		Polygon    []int `json:"polygon"`
+		PageNumber int       `json:"pageNumber"`
+		Polygon    []float64 `json:"polygon"`
 	}
 
 	Paragraph struct {
@@ -39,21 +39,21 @@ type (
 		Pages           []struct {
 			PageNumber int     `json:"pageNumber"`
 			Angle      float64 `json:"angle"`
-			Width      int     `json:"width"`
-			Height     int     `json:"height"`
+			Width      float64 `json:"width"`
+			Height     float64 `json:"height"`
 			Unit       string  `json:"unit"`
 			Words      []struct {
-				Content    string  `json:"content"`
-				Polygon    []int   `json:"polygon"`
-				Confidence float64 `json:"confidence"`
+				Content    string    `json:"content"`
+				Polygon    []float64 `json:"polygon"`
+				Confidence float64   `json:"confidence"`
 				Span       struct {
 					Offset int `json:"offset"`
 					Length int `json:"length"`
 				} `json:"span"`
 			} `json:"words"`
 			Lines []struct {
-				Content string `json:"content"`
-				Polygon []int  `json:"polygon"`
+				Content string    `json:"content"`
+				Polygon []float64 `json:"polygon"`
 				Spans   []struct {
 					Offset int `json:"offset"`
 					Length int `json:"length"`
@@ -65,9 +65,32 @@ type (
 			} `json:"spans"`
 			Kind string `json:"kind"`
 		} `json:"pages"`
-		Paragraphs []Paragraph `json:"paragraphs"`
-		Styles     []Style     `json:"styles"`
-		Languages  []Language  `json:"languages"`
+		Paragraphs []Paragraph        `json:"paragraphs"`
+		Styles     []Style            `json:"styles"`
+		Languages  []Language         `json:"languages"`
+		Documents  []AnalyzedDocument `json:"documents"`
+	}
+
+	DocumentField struct {
+		Type               string                   `json:"type"`
+		ValueString        string                   `json:"valueString"`
+		ValueDate          string                   `json:"valueDate"`
+		ValueNumber        float64                  `json:"valueNumber"`
+		ValueCountryRegion string                   `json:"valueCountryRegion"`
+		ValueObject        map[string]DocumentField `json:"valueObject"`
+		ValueArray         []DocumentField          `json:"valueArray"`
+		Content            string                   `json:"content"`
+		BoundingRegions    []BoundingRegion         `json:"boundingRegions"`
+		Spans              []Span                   `json:"spans"`
+		Confidence         float64                  `json:"confidence"`
+	}
+
+	AnalyzedDocument struct {
+		DocType         string                   `json:"docType"`
+		BoundingRegions []BoundingRegion         `json:"boundingRegions"`
+		Fields          map[string]DocumentField `json:"fields"`
+		Spans           []Span                   `json:"spans"`
+		Confidence      float64                  `json:"confidence"`
 	}
 
 	OCRAnalysisResult struct {
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Bureau-Inc/overwatch-common/logger"
+	"github.com/Bureau-Inc/overwatch-common/logger/tag"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	defaultMetricsNamespace = "nergpt"
+	tenantHeader            = "x-tenant-id"
+	authorizerTenantKey     = "tenant"
+)
+
+// priceTable converts usage to cost. PRICE_TABLE takes the same json to override any of the prices, e.g.
+// PRICE_TABLE={"ocrPerPage": {"azure/pan-custom-v2": 0.03}}.
+type priceTable struct {
+	Currency string `json:"currency"`
+	// PromptPer1K and CompletionPer1K are the llm prices per thousand tokens
+	PromptPer1K     float64 `json:"promptPer1K"`
+	CompletionPer1K float64 `json:"completionPer1K"`
+	// OCRPerPage is keyed by engine/model, falling back to the engine alone
+	OCRPerPage map[string]float64 `json:"ocrPerPage"`
+}
+
+// defaultPrices are the list prices at the time of writing.
+var defaultPrices = priceTable{
+	Currency:        "USD",
+	PromptPer1K:     0.0015,
+	CompletionPer1K: 0.002,
+	OCRPerPage: map[string]float64{
+		engineAzure:                              0.0015,
+		engineAzure + "/" + azureLayoutModel:     0.01,
+		engineAzure + "/" + azureIDDocumentModel: 0.01,
+		engineRekognition:                        0.001,
+		engineTextract:                           0.0015,
+		engineTextract + "/" + textractAnalyzeID: 0.025,
+		engineTesseract:                          0,
+	},
+}
+
+// metricsOut receives the metric lines, the cli keeps them out of its output.
+var metricsOut io.Writer = os.Stdout
+
+// usageReport is the usage of the paid apis for one request and what it cost.
+type usageReport struct {
+	LLMCalls         int                `json:"llmCalls"`
+	PromptTokens     int                `json:"promptTokens"`
+	CompletionTokens int                `json:"completionTokens"`
+	TotalTokens      int                `json:"totalTokens"`
+	OCRPages         map[string]int     `json:"ocrPages"`
+	CachedOCRRuns    int                `json:"cachedOcrRuns,omitempty"`
+	LLMCost          float64            `json:"llmCost"`
+	OCRCost          map[string]float64 `json:"ocrCost"`
+	TotalCost        float64            `json:"totalCost"`
+	Currency         string             `json:"currency"`
+}
+
+func addUsage(a, b Usage) Usage {
+	return Usage{
+		PromptTokens:     a.PromptTokens + b.PromptTokens,
+		CompletionTokens: a.CompletionTokens + b.CompletionTokens,
+		TotalTokens:      a.TotalTokens + b.TotalTokens,
+	}
+}
+
+func loadPriceTable() (priceTable, error) {
+	prices := defaultPrices
+	prices.OCRPerPage = make(map[string]float64, len(defaultPrices.OCRPerPage))
+	for k, v := range defaultPrices.OCRPerPage {
+		prices.OCRPerPage[k] = v
+	}
+
+	if env := os.Getenv("PRICE_TABLE"); env != "" {
+		if err := json.Unmarshal([]byte(env), &prices); err != nil {
+			return priceTable{}, fmt.Errorf("failed to decode PRICE_TABLE: %v", err)
+		}
+	}
+	return prices, nil
+}
+
+func (p priceTable) ocrPrice(engine string, model string) float64 {
+	if price, ok := p.OCRPerPage[engine+"/"+model]; ok {
+		return price
+	}
+	return p.OCRPerPage[engine]
+}
+
+// buildUsageReport adds up the pages of every ocr run and the tokens of every llm call of the request.
+func buildUsageReport(runs []*engineRun, extractions []*extraction, prices priceTable) *usageReport {
+	r := &usageReport{
+		OCRPages: map[string]int{},
+		OCRCost:  map[string]float64{},
+		Currency: prices.Currency,
+	}
+
+	for _, run := range runs {
+		if run.Cached {
+			r.CachedOCRRuns++
+			continue
+		}
+		r.OCRPages[run.Engine] += run.Pages
+		r.OCRCost[run.Engine] = roundCost(r.OCRCost[run.Engine] + float64(run.Pages)*prices.ocrPrice(run.Engine, run.Model))
+	}
+
+	for _, ex := range extractions {
+		if ex == nil {
+			continue
+		}
+		r.LLMCalls += ex.Calls
+		r.PromptTokens += ex.Usage.PromptTokens
+		r.CompletionTokens += ex.Usage.CompletionTokens
+		r.TotalTokens += ex.Usage.TotalTokens
+	}
+	r.LLMCost = prices.llmCost(r.PromptTokens, r.CompletionTokens)
+
+	r.TotalCost = r.LLMCost
+	for _, c := range r.OCRCost {
+		r.TotalCost += c
+	}
+	r.TotalCost = roundCost(r.TotalCost)
+	return r
+}
+
+// llmCost prices the tokens of llm calls.
+func (p priceTable) llmCost(promptTokens int, completionTokens int) float64 {
+	return roundCost(float64(promptTokens)/1000*p.PromptPer1K + float64(completionTokens)/1000*p.CompletionPer1K)
+}
+
+func roundCost(c float64) float64 {
+	return math.Round(c*1e6) / 1e6
+}
+
+// trustTenantHeader lets the x-tenant-id header name the tenant of requests that have no authenticated
+// identity. Any caller can send the header, so behind api gateway it is ignored unless
+// TRUST_TENANT_HEADER=true, serve mode has no gateway identity and turns it on.
+var trustTenantHeader = os.Getenv("TRUST_TENANT_HEADER") == "true"
+
+// tenantOf identifies who the request is billed to, the tenant set by the authorizer or else the id of
+// the api gateway key. The key itself is a secret and never used.
+func tenantOf(req events.APIGatewayProxyRequest) string {
+	if tenant, ok := req.RequestContext.Authorizer[authorizerTenantKey].(string); ok && tenant != "" {
+		return tenant
+	}
+	if id := req.RequestContext.Identity.APIKeyID; id != "" {
+		return id
+	}
+	if !trustTenantHeader {
+		return "unknown"
+	}
+	for k, v := range req.Headers {
+		if v != "" && strings.EqualFold(k, tenantHeader) {
+			return v
+		}
+	}
+	return "unknown"
+}
+
+// emitUsageMetrics writes the usage in the cloudwatch embedded metric format. Lambda sends stdout to
+// cloudwatch logs, which turns the line into metrics per tenant and doc type without any api call.
+func emitUsageMetrics(tenant string, docType string, usage *usageReport) {
+	if usage == nil {
+		return
+	}
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+
+	type metric struct {
+		Name string `json:"Name"`
+		Unit string `json:"Unit"`
+	}
+	metrics := []metric{
+		{Name: "LLMCalls", Unit: "Count"},
+		{Name: "PromptTokens", Unit: "Count"},
+		{Name: "CompletionTokens", Unit: "Count"},
+		{Name: "TotalTokens", Unit: "Count"},
+		{Name: "OCRPages", Unit: "Count"},
+		{Name: "Cost", Unit: "None"},
+	}
+
+	pages := 0
+	engines := make([]string, 0, len(usage.OCRPages))
+	for e, p := range usage.OCRPages {
+		pages += p
+		engines = append(engines, e)
+	}
+	sort.Strings(engines)
+
+	line := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  namespace,
+				"Dimensions": [][]string{{"Tenant"}, {"Tenant", "DocType"}},
+				"Metrics":    metrics,
+			}},
+		},
+		"Tenant":           tenant,
+		"DocType":          docType,
+		"Engines":          engines,
+		"Currency":         usage.Currency,
+		"LLMCalls":         usage.LLMCalls,
+		"PromptTokens":     usage.PromptTokens,
+		"CompletionTokens": usage.CompletionTokens,
+		"TotalTokens":      usage.TotalTokens,
+		"OCRPages":         pages,
+		"Cost":             usage.TotalCost,
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		logger.ERROR("failed to encode usage metrics", tag.NewErrorTag(err))
+		return
+	}
+	fmt.Fprintln(metricsOut, string(b))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Bureau-Inc/overwatch-common/logger"
+	"github.com/Bureau-Inc/overwatch-common/logger/tag"
+)
+
+const (
+	// the receiver recomputes the signature over "<timestamp>.<body>" with the shared secret and rejects
+	// old timestamps to stop replays
+	webhookSignatureHeader = "X-Nergpt-Signature"
+	webhookTimestampHeader = "X-Nergpt-Timestamp"
+	webhookJobHeader       = "X-Nergpt-Job-Id"
+
+	defaultWebhookMaxAttempts = 5
+	webhookBaseBackoff        = time.Second
+	webhookMaxBackoff         = 30 * time.Second
+	webhookTimeout            = 10 * time.Second
+
+	// callback statuses of a job
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+// webhookDelivery is one attempt at posting the job result to the callback url.
+type webhookDelivery struct {
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+var errCallbackAddress = errors.New("callback address is not public")
+
+// webhookClient does not follow redirects, they could lead the callback off the https url that was checked.
+// It connects directly, never through a proxy, and only to public addresses, which are checked on every
+// connection so a host resolving to another address after validateCallbackURL cannot reach internal ones.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network string, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !webhookAddressAllowed(ip) {
+					return fmt.Errorf("%w: %s", errCallbackAddress, host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func webhookSecret() []byte {
+	return []byte(os.Getenv("WEBHOOK_SECRET"))
+}
+
+// cgnatRange is the shared address space of carrier grade nat, not reachable from the internet either.
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// webhookAddressAllowed keeps callbacks away from loopback, private and link-local addresses, the
+// instance metadata service among them. WEBHOOK_ALLOW_PRIVATE=true lifts it for local runs.
+func webhookAddressAllowed(ip net.IP) bool {
+	if os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true" {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnatRange.Contains(ip))
+}
+
+// validateCallbackURL only accepts https urls of hosts resolving to public addresses, plain http is allowed
+// for local runs with WEBHOOK_ALLOW_HTTP=true. Callbacks are signed, so a secret has to be configured.
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid callbackUrl: %s", raw)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && os.Getenv("WEBHOOK_ALLOW_HTTP") == "true") {
+		return fmt.Errorf("callbackUrl must use https")
+	}
+	if len(webhookSecret()) == 0 {
+		return fmt.Errorf("callbacks are not configured, WEBHOOK_SECRET is missing")
+	}
+
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil || len(ips) == 0 {
+		return fmt.Errorf("failed to resolve callbackUrl host %s", u.Hostname())
+	}
+	for _, ip := range ips {
+		if !webhookAddressAllowed(ip) {
+			return fmt.Errorf("callbackUrl host %s resolves to %s, which is not public", u.Hostname(), ip)
+		}
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>", prefixed with the algorithm.
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts the body to the callback url until it is accepted, backing off exponentially with
+// jitter between attempts. Client errors other than 408 and 429 are not retried. Every attempt is returned.
+func deliverWebhook(callbackURL string, jobID string, body []byte) ([]webhookDelivery, error) {
+	maxAttempts := defaultWebhookMaxAttempts
+	if n, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS")); err == nil && n > 0 {
+		maxAttempts = n
+	}
+
+	var deliveries []webhookDelivery
+	backoff := webhookBaseBackoff
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		d, retry := postWebhook(callbackURL, jobID, body, attempt)
+		deliveries = append(deliveries, d)
+		if d.Error == "" {
+			return deliveries, nil
+		}
+		logger.ERROR("failed to deliver webhook", tag.NewStringTag("jobId", jobID), tag.NewAnyTag("delivery", d))
+		if !retry || attempt == maxAttempts {
+			break
+		}
+
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		backoff *= 2
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+	return deliveries, fmt.Errorf("failed to deliver webhook after %d attempts", len(deliveries))
+}
+
+func postWebhook(callbackURL string, jobID string, body []byte, attempt int) (webhookDelivery, bool) {
+	start := time.Now()
+	d := webhookDelivery{Attempt: attempt, At: start.UTC()}
+
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		d.Error = fmt.Sprintf("failed to construct request: %v", err)
+		d.DurationMs = time.Since(start).Milliseconds()
+		return d, false
+	}
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add(webhookTimestampHeader, timestamp)
+	req.Header.Add(webhookSignatureHeader, signWebhook(webhookSecret(), timestamp, body))
+	req.Header.Add(webhookJobHeader, jobID)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		d.Error = fmt.Sprintf("failed to make request: %v", err)
+		d.DurationMs = time.Since(start).Milliseconds()
+		// the host resolving to an internal address again would be refused again
+		return d, !errors.Is(err, errCallbackAddress)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	d.StatusCode = resp.StatusCode
+	d.DurationMs = time.Since(start).Milliseconds()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return d, false
+	}
+	d.Error = fmt.Sprintf("received unexpected status code in response: %d", resp.StatusCode)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return d, retry
+}